@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const dnsdistConfigPath = "/etc/dnsdist/dnsdist.conf"
+
+var apiKeyRegexp = regexp.MustCompile(`setWebserverConfig\(.*\{.*\bapiKey\s*=\s*"(.+?)"`)
+
+// apiKeyFromConfig returns the apiKey of setWebserverConfig in the dnsdist
+// configuration file
+func apiKeyFromConfig(path string) string {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	res := apiKeyRegexp.FindAllSubmatch(buf, -1)
+	if len(res) < 1 {
+		return ""
+	}
+	return string(res[0][1])
+}
+
+type apiKeyState struct {
+	ModTime time.Time `json:"mod_time"`
+	Size    int64     `json:"size"`
+	APIKey  string    `json:"api_key"`
+}
+
+// privateDir reports whether dir is a directory accessible only by its owner
+func privateDir(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir() && fi.Mode().Perm()&0077 == 0
+}
+
+// cachedAPIKey returns the API key of the configuration file. the key is
+// cached in a state file and the configuration is parsed again only when its
+// mtime or size changes. the key is a secret copied from a root-readable
+// file, so it is cached only when --work-dir is a private directory, not in
+// the shared temp dir.
+func (p *Plugin) cachedAPIKey(path string) string {
+	if p.WorkDir == "" || !privateDir(p.WorkDir) {
+		return apiKeyFromConfig(path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	statePath := p.stateFile("apikey")
+	state := apiKeyState{}
+	if err := p.loadState(statePath, &state); err != nil {
+		log.Printf("api key state (ignore): %v", err)
+	}
+	if state.ModTime.Equal(fi.ModTime()) && state.Size == fi.Size() {
+		return state.APIKey
+	}
+	key := apiKeyFromConfig(path)
+	state = apiKeyState{ModTime: fi.ModTime(), Size: fi.Size(), APIKey: key}
+	if err := p.saveStateMode(statePath, state, 0600); err != nil {
+		log.Printf("api key state: %v", err)
+	}
+	return key
+}
+
+// apiKeys returns the keys of --api-key. comma-separated keys are split.
+func (o *Opt) apiKeys() []string {
+	var keys []string
+	for _, k := range o.APIKey {
+		for _, key := range strings.Split(k, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+type apiKeyCandidateState struct {
+	// sha1 of the key, not to save the key itself
+	Hash string `json:"hash"`
+}
+
+func apiKeyHash(key string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key)))
+}
+
+// fetchWithAPIKeys calls fetch with each of APIKeys until one is not
+// rejected by dnsdist. the key that worked is remembered in a state file and
+// tried first on the next run. p.APIKey is left set to the working key for
+// the following requests.
+func (p *Plugin) fetchWithAPIKeys(fetch func() error) error {
+	path := p.stateFile("apikey-candidate")
+	state := apiKeyCandidateState{}
+	if err := p.loadState(path, &state); err != nil {
+		log.Printf("api key candidate state (ignore): %v", err)
+	}
+	keys := make([]string, 0, len(p.APIKeys))
+	for _, key := range p.APIKeys {
+		if apiKeyHash(key) == state.Hash {
+			keys = append([]string{key}, keys...)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+
+	var err error
+	for _, key := range keys {
+		p.APIKey = key
+		err = fetch()
+		if err == nil {
+			if hash := apiKeyHash(key); hash != state.Hash {
+				if err := p.saveState(path, apiKeyCandidateState{Hash: hash}); err != nil {
+					log.Printf("api key candidate state: %v", err)
+				}
+			}
+			return nil
+		}
+		var se *statusError
+		if !errors.As(err, &se) || (se.StatusCode != http.StatusUnauthorized && se.StatusCode != http.StatusForbidden) {
+			return err
+		}
+	}
+	return err
+}
+
+// withAPIKeys calls fetch through withSchemeAuto, trying each of APIKeys
+// when more than one is given
+func (p *Plugin) withAPIKeys(fetch func() error) error {
+	auto := func() error {
+		return p.withSchemeAuto(fetch)
+	}
+	if len(p.APIKeys) > 1 {
+		return p.fetchWithAPIKeys(auto)
+	}
+	return auto()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeDnsdistConf(t *testing.T, path, key string, mtime time.Time) {
+	t.Helper()
+	conf := `setWebserverConfig({password="x", apiKey="` + key + `"})` + "\n"
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachedAPIKey(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "dnsdist.conf")
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	writeDnsdistConf(t, conf, "key1", mtime)
+
+	dir := filepath.Join(t.TempDir(), "work")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	p := &Plugin{Prefix: "dnsdist", WorkDir: dir}
+	if got := p.cachedAPIKey(conf); got != "key1" {
+		t.Fatalf("got %q, want key1", got)
+	}
+
+	// the cached key is used while the mtime and the size are unchanged
+	writeDnsdistConf(t, conf, "key2", mtime)
+	if got := p.cachedAPIKey(conf); got != "key1" {
+		t.Errorf("got %q, want the cached key1", got)
+	}
+	// parsed again when the mtime changes
+	writeDnsdistConf(t, conf, "key2", mtime.Add(time.Minute))
+	if got := p.cachedAPIKey(conf); got != "key2" {
+		t.Errorf("got %q, want key2 after the mtime change", got)
+	}
+
+	fi, err := os.Stat(p.stateFile("apikey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("state permission: got %o, want 600", perm)
+	}
+}
+
+func TestCachedAPIKeySharedDir(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "dnsdist.conf")
+	writeDnsdistConf(t, conf, "key1", time.Now())
+
+	for _, p := range []*Plugin{
+		{Prefix: "dnsdist"},
+		{Prefix: "dnsdist", WorkDir: t.TempDir()},
+	} {
+		dir := p.WorkDir
+		if dir == "" {
+			dir = t.TempDir()
+			t.Setenv("MACKEREL_PLUGIN_WORKDIR", dir)
+		}
+		if err := os.Chmod(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		if got := p.cachedAPIKey(conf); got != "key1" {
+			t.Errorf("got %q, want key1", got)
+		}
+		if _, err := os.Stat(p.stateFile("apikey")); !os.IsNotExist(err) {
+			t.Errorf("api key is cached in %s: %v", dir, err)
+		}
+	}
+}
+
+func TestAPIKeyRotation(t *testing.T) {
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		keys = append(keys, key)
+		if key != "new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(testStats))
+	}))
+	defer ts.Close()
+
+	opt := Opt{APIKey: []string{"old, new"}}
+	p := newTestPlugin(t, ts.URL)
+	p.APIKeys = opt.apiKeys()
+	p.APIKey = p.APIKeys[0]
+	if _, err := p.fetchMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "old,new" {
+		t.Errorf("tried %v, want old then new", keys)
+	}
+	if p.APIKey != "new" {
+		t.Errorf("APIKey is left %q", p.APIKey)
+	}
+
+	// the working key is tried first on the next run
+	keys = nil
+	p.APIKey = p.APIKeys[0]
+	if _, err := p.fetchMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "new" {
+		t.Errorf("tried %v, want new only", keys)
+	}
+	buf, err := os.ReadFile(p.stateFile("apikey-candidate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), "new") {
+		t.Errorf("the key is saved in the state: %s", buf)
+	}
+}
+
+func TestAPIKeyRotationError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	p := newTestPlugin(t, ts.URL)
+	p.APIKeys = []string{"a", "b"}
+	_, err := p.fetchMetrics()
+	var se *statusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %v", err)
+	}
+	// other errors are not retried with the next key
+	if p.APIKey != "a" {
+		t.Errorf("APIKey: got %q, want a", p.APIKey)
+	}
+}
+
+func TestAPIKeyRotationAPI(t *testing.T) {
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		keys = append(keys, key)
+		if key != "new" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(testServersAPI))
+	}))
+	defer ts.Close()
+
+	for name, fetch := range map[string]func(p *Plugin) error{
+		"check": func(p *Plugin) error {
+			if code, msg := p.HealthCheck(); code != StatusCodeOK {
+				return errors.New(msg)
+			}
+			return nil
+		},
+		"list-backends": func(p *Plugin) error {
+			return p.ListBackends(io.Discard)
+		},
+	} {
+		keys = nil
+		p := newTestPlugin(t, ts.URL)
+		p.HealthURL = ts.URL
+		p.APIKeys = []string{"old", "new"}
+		p.APIKey = p.APIKeys[0]
+		if err := fetch(p); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if strings.Join(keys, ",") != "old,new" {
+			t.Errorf("%s: tried %v, want old then new", name, keys)
+		}
+	}
+}
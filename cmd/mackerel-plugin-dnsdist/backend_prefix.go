@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// --prefix-from-backend emits metrics of each backend under its own graphs,
+// such as dnsdist.backend1.load-vs-weight and dnsdist.backend1-rcode.noerror,
+// instead of the backend.# wildcard graphs. every backend adds graph
+// definitions, so the number of graphs grows with the number of backends.
+// a backend whose key is also the key of another graph, or ends with -rcode
+// or -latency-bucket, stays in backend.#.
+
+// reservedGraphKeys returns keys of the graphs other than the per-backend ones
+// and their first segments, which prefix the wildcard metrics
+func (p *Plugin) reservedGraphKeys() map[string]bool {
+	reserved := map[string]bool{}
+	for k := range p.graphDefinition() {
+		reserved[k] = true
+		reserved[strings.SplitN(k, ".", 2)[0]] = true
+	}
+	return reserved
+}
+
+// backendGraphAvailable reports whether the graphs of a backend do not collide
+// with other graphs, including the -rcode and -latency-bucket graphs of other
+// backends
+func backendGraphAvailable(key string, reserved map[string]bool) bool {
+	for _, suffix := range []string{"-rcode", "-latency-bucket"} {
+		if reserved[key+suffix] || strings.HasSuffix(key, suffix) {
+			return false
+		}
+	}
+	return !reserved[key]
+}
+
+// prefixFromBackend moves backend.<key>.* metrics to the per-backend graphs
+func (p *Plugin) prefixFromBackend(metrics map[string]float64) map[string]float64 {
+	reserved := p.reservedGraphKeys()
+	result := map[string]float64{}
+	for k, v := range metrics {
+		rest := strings.TrimPrefix(k, "backend.")
+		i := strings.Index(rest, ".")
+		if rest == k || i < 0 || !backendGraphAvailable(rest[:i], reserved) {
+			result[k] = v
+			continue
+		}
+		// backend.<key>.rcode.* and backend.<key>.latency-bucket.* move to
+		// <key>-rcode.* and <key>-latency-bucket.*
+		key, metric := rest[:i], rest[i+1:]
+		if j := strings.Index(metric, "."); j >= 0 {
+			result[key+"-"+metric[:j]+metric[j:]] = v
+		} else {
+			result[key+"."+metric] = v
+		}
+	}
+	return result
+}
+
+// addBackendGraphs adds the graphs of each backend in the servers API. the
+// response fetched with the metrics is used, and the servers API is fetched
+// only when there is none, such as on MACKEREL_AGENT_PLUGIN_META. stat keys
+// of non-wildcard metrics are shared by all graphs, so the metrics of each
+// backend are matched by wildcard.
+func (p *Plugin) addBackendGraphs(graphs map[string]mp.Graphs) {
+	api := p.servers
+	if api == nil {
+		var err error
+		api, err = p.fetchServersAPI()
+		if err != nil {
+			log.Printf("backend graphs: %v", err)
+			return
+		}
+		p.servers = api
+	}
+	reserved := p.reservedGraphKeys()
+	labelPrefix := p.labelPrefix()
+	for _, s := range api.Servers {
+		if !p.backendSelected(s) {
+			continue
+		}
+		key := backendKey(s)
+		if !backendGraphAvailable(key, reserved) {
+			continue
+		}
+		graphs[key] = mp.Graphs{
+			Label: labelPrefix + ": Backend " + key,
+			Unit:  graphs["backend.#"].Unit,
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1"},
+			},
+		}
+		graphs[key+"-rcode"] = mp.Graphs{
+			Label: labelPrefix + ": Backend " + key + " Responses by rcode",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Diff: true},
+			},
+		}
+		if p.BackendLatencyBuckets {
+			graphs[key+"-latency-bucket"] = mp.Graphs{
+				Label:   labelPrefix + ": Backend " + key + " Latency Buckets",
+				Unit:    "integer",
+				Metrics: graphs["backend.#.latency-bucket"].Metrics,
+			}
+		}
+	}
+}
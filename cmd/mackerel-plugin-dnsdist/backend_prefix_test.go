@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const testServersAPI = `{"servers": [
+	{"name": "b1", "address": "192.0.2.1:53", "state": "up", "outstanding": 4, "weight": 2, "queries": 10, "noerror": 7},
+	{"name": "", "address": "[2001:db8::1]:53", "state": "up", "outstanding": 0, "weight": 1, "queries": 3},
+	{"name": "cache", "address": "192.0.2.3:53", "state": "up", "outstanding": 1, "weight": 1, "queries": 5}
+]}`
+
+func newPrefixFromBackendServer(t *testing.T) (*httptest.Server, *int64) {
+	t.Helper()
+	var servers int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/jsonstat" {
+			w.Write([]byte(testStats))
+			return
+		}
+		atomic.AddInt64(&servers, 1)
+		w.Write([]byte(testServersAPI))
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &servers
+}
+
+func TestPrefixFromBackend(t *testing.T) {
+	ts, servers := newPrefixFromBackendServer(t)
+	p := newTestPlugin(t, ts.URL)
+	p.BackendMetrics = true
+	p.PrefixFromBackend = true
+
+	m, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"b1.load-vs-weight", "b1-rcode.noerror", "2001_db8__1_53.load-vs-weight", "backend.cache.load-vs-weight"} {
+		if _, ok := m[k]; !ok {
+			t.Errorf("%s is not emitted", k)
+		}
+	}
+	// outstanding 4 / weight 2
+	if m["b1.load-vs-weight"] != 2 {
+		t.Errorf("b1.load-vs-weight: got %v, want 2", m["b1.load-vs-weight"])
+	}
+	for _, k := range []string{"backend.b1.load-vs-weight", "backend.b1.rcode.noerror", "cache.load-vs-weight"} {
+		if _, ok := m[k]; ok {
+			t.Errorf("%s is emitted", k)
+		}
+	}
+
+	// go-mackerel-plugin calls GraphDefinition twice after FetchMetrics
+	graphs := p.GraphDefinition()
+	p.GraphDefinition()
+	if n := atomic.LoadInt64(servers); n != 1 {
+		t.Errorf("servers API is requested %d times", n)
+	}
+	for _, k := range []string{"b1", "b1-rcode", "2001_db8__1_53", "2001_db8__1_53-rcode", "backend.#", "backend.#.rcode"} {
+		if _, ok := graphs[k]; !ok {
+			t.Errorf("graph %s is not defined", k)
+		}
+	}
+	// a backend named after another graph stays in backend.#
+	if g := graphs["cache"]; g.Label != "Dnsdist: Packet Cache" {
+		t.Errorf("graph cache is replaced: %+v", g)
+	}
+	if _, ok := graphs["cache-rcode"]; ok {
+		t.Error("graph cache-rcode is defined")
+	}
+}
+
+func TestPrefixFromBackendMeta(t *testing.T) {
+	ts, servers := newPrefixFromBackendServer(t)
+	p := newTestPlugin(t, ts.URL)
+	p.BackendMetrics = true
+	p.PrefixFromBackend = true
+
+	// graph definitions without fetching metrics fetch the servers API once
+	graphs := p.GraphDefinition()
+	p.GraphDefinition()
+	if n := atomic.LoadInt64(servers); n != 1 {
+		t.Errorf("servers API is requested %d times", n)
+	}
+	if _, ok := graphs["b1"]; !ok {
+		t.Error("graph b1 is not defined")
+	}
+}
+
+func TestPrefixFromBackendKeys(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", BackendMetrics: true, BackendLatencyBuckets: true}
+	m := p.prefixFromBackend(map[string]float64{
+		"queries":                         1,
+		"backend.b1.flaps":                2,
+		"backend.b1.rcode.servfail":       3,
+		"backend.b1.latency-bucket.0-1":   4,
+		"backend.queries.flaps":           5,
+		"backend.b1-rcode.flaps":          6,
+		"frontend.udp-192_0_2_1_53.x":     7,
+		"cache-entries-by-type.a":         8,
+		"backend.cache-entries-by-type.x": 9,
+	})
+	want := map[string]float64{
+		"queries":                         1,
+		"b1.flaps":                        2,
+		"b1-rcode.servfail":               3,
+		"b1-latency-bucket.0-1":           4,
+		"backend.queries.flaps":           5,
+		"backend.b1-rcode.flaps":          6,
+		"frontend.udp-192_0_2_1_53.x":     7,
+		"cache-entries-by-type.a":         8,
+		"backend.cache-entries-by-type.x": 9,
+	}
+	if len(m) != len(want) {
+		t.Errorf("got %v", m)
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+}
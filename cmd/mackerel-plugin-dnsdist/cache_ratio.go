@@ -0,0 +1,47 @@
+package main
+
+import "log"
+
+type cacheSample struct {
+	Hits   float64 `json:"hits"`
+	Misses float64 `json:"misses"`
+}
+
+type cacheRatioState struct {
+	Samples []cacheSample `json:"samples"`
+}
+
+// smoothedCacheHitRatio returns the cache hit ratio (%) over the last
+// CacheRatioWindow runs. the counters of past runs are kept in a state file.
+// it returns false until two samples are available.
+func (p *Plugin) smoothedCacheHitRatio(stats map[string]float64) (float64, bool) {
+	path := p.stateFile("cache-ratio")
+	state := cacheRatioState{}
+	if err := p.loadState(path, &state); err != nil {
+		log.Printf("cache ratio state (ignore): %v", err)
+	}
+
+	cur := cacheSample{Hits: stats["cache-hits"], Misses: stats["cache-misses"]}
+	if n := len(state.Samples); n > 0 {
+		last := state.Samples[n-1]
+		if cur.Hits < last.Hits || cur.Misses < last.Misses {
+			// counters seem to be reset
+			state.Samples = nil
+		}
+	}
+	state.Samples = append(state.Samples, cur)
+	if n := len(state.Samples); n > p.CacheRatioWindow+1 {
+		state.Samples = state.Samples[n-p.CacheRatioWindow-1:]
+	}
+	if err := p.saveState(path, state); err != nil {
+		log.Printf("cache ratio state: %v", err)
+	}
+
+	oldest := state.Samples[0]
+	hits := cur.Hits - oldest.Hits
+	total := hits + cur.Misses - oldest.Misses
+	if total <= 0 {
+		return 0, false
+	}
+	return hits / total * 100, true
+}
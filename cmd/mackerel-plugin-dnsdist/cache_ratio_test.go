@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestSmoothedCacheHitRatio(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir(), CacheRatioWindow: 2}
+	tests := []struct {
+		hits, misses float64
+		want         float64
+		ok           bool
+	}{
+		// fewer samples than the window
+		{0, 0, 0, false},
+		{10, 10, 50, true},
+		{30, 10, 75, true},
+		// the oldest sample is dropped out of the window
+		{50, 50, 50, true},
+		// counters are reset on a restart of dnsdist
+		{5, 5, 0, false},
+		{15, 5, 100, true},
+	}
+	for i, tt := range tests {
+		got, ok := p.smoothedCacheHitRatio(map[string]float64{"cache-hits": tt.hits, "cache-misses": tt.misses})
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("run %d: got %v %v, want %v %v", i, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSmoothedCacheHitRatioMetric(t *testing.T) {
+	ts, _ := newTestServer(t, testStats)
+	p := newTestPlugin(t, ts.URL)
+	p.CacheRatioWindow = 3
+	m, err := p.fetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["cache-hit-ratio-smoothed"]; ok {
+		t.Error("cache-hit-ratio-smoothed is emitted with a single sample")
+	}
+	if _, ok := p.GraphDefinition()["cache-ratio"]; !ok {
+		t.Error("graph cache-ratio is not defined")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var statusLabels = map[int]string{
+	StatusCodeOK:       "OK",
+	StatusCodeWARNING:  "WARNING",
+	StatusCodeCRITICAL: "CRITICAL",
+	StatusCodeUNKNOWN:  "UNKNOWN",
+}
+
+// servfailRate returns servfail-responses/responses in percent
+func servfailRate(m map[string]float64) float64 {
+	if m["responses"] == 0 {
+		return 0
+	}
+	return m["servfail-responses"] / m["responses"] * 100
+}
+
+// Check fetches stats and evaluates them against the thresholds. a zero
+// threshold is disabled.
+func (p *Plugin) Check(warnServfailRate, critServfailRate float64) (int, string) {
+	m, err := p.fetchMetrics()
+	if err != nil {
+		return StatusCodeCRITICAL, fmt.Sprintf("failed to fetch stats: %v", err)
+	}
+
+	rate := servfailRate(m)
+	msg := fmt.Sprintf("servfail rate %.2f%% (%s/%s)",
+		rate, formatFloat(m["servfail-responses"]), formatFloat(m["responses"]))
+	switch {
+	case critServfailRate > 0 && rate >= critServfailRate:
+		return StatusCodeCRITICAL, msg
+	case warnServfailRate > 0 && rate >= warnServfailRate:
+		return StatusCodeWARNING, msg
+	}
+	return StatusCodeOK, msg
+}
+
+// HealthCheck requests HealthURL and checks that it returns 200 with a JSON
+// body
+func (p *Plugin) HealthCheck() (int, string) {
+	start := time.Now()
+	var v interface{}
+	err := p.withAPIKeys(func() error {
+		return p.fetchJSON(p.HealthURL, p.apiTimeout(), &v)
+	})
+	if err != nil {
+		return StatusCodeCRITICAL, err.Error()
+	}
+	return StatusCodeOK, fmt.Sprintf("%s returned valid JSON in %s", p.HealthURL, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		stats string
+		warn  float64
+		crit  float64
+		want  int
+	}{
+		// servfail rate 1%
+		{`{"responses": 100, "servfail-responses": 1}`, 2, 5, StatusCodeOK},
+		{`{"responses": 100, "servfail-responses": 2}`, 2, 5, StatusCodeWARNING},
+		{`{"responses": 100, "servfail-responses": 5}`, 2, 5, StatusCodeCRITICAL},
+		{`{"responses": 100, "servfail-responses": 50}`, 2, 0, StatusCodeWARNING},
+		{`{"responses": 100, "servfail-responses": 50}`, 0, 0, StatusCodeOK},
+		// no responses yet
+		{`{"responses": 0, "servfail-responses": 0}`, 2, 5, StatusCodeOK},
+		{`{"queries": 0}`, 2, 5, StatusCodeOK},
+	}
+	for _, tt := range tests {
+		ts, _ := newTestServer(t, tt.stats)
+		p := newTestPlugin(t, ts.URL)
+		code, msg := p.Check(tt.warn, tt.crit)
+		if code != tt.want {
+			t.Errorf("%s warn %v crit %v: got %s (%s), want %s", tt.stats, tt.warn, tt.crit, statusLabels[code], msg, statusLabels[tt.want])
+		}
+	}
+}
+
+func TestCheckMessage(t *testing.T) {
+	ts, _ := newTestServer(t, `{"responses": 200, "servfail-responses": 5}`)
+	p := newTestPlugin(t, ts.URL)
+	_, msg := p.Check(2, 5)
+	if msg != "servfail rate 2.50% (5/200)" {
+		t.Errorf("unexpected message: %s", msg)
+	}
+}
+
+func TestCheckFetchError(t *testing.T) {
+	ts, _ := newTestServer(t, `not json`)
+	p := newTestPlugin(t, ts.URL)
+	code, msg := p.Check(2, 5)
+	if code != StatusCodeCRITICAL || !strings.HasPrefix(msg, "failed to fetch stats") {
+		t.Errorf("got %s: %s", statusLabels[code], msg)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		body   string
+		want   int
+	}{
+		{http.StatusOK, `{"servers": []}`, StatusCodeOK},
+		{http.StatusServiceUnavailable, `{"servers": []}`, StatusCodeCRITICAL},
+		{http.StatusUnauthorized, `{"error": "unauthorized"}`, StatusCodeCRITICAL},
+		{http.StatusOK, `<html>not json</html>`, StatusCodeCRITICAL},
+	} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte(tt.body))
+		}))
+		p := newTestPlugin(t, ts.URL)
+		p.HealthURL = ts.URL
+		code, msg := p.HealthCheck()
+		ts.Close()
+		if code != tt.want {
+			t.Errorf("%d %s: got %s (%s), want %s", tt.status, tt.body, statusLabels[code], msg, statusLabels[tt.want])
+		}
+	}
+}
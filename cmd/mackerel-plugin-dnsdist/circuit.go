@@ -0,0 +1,52 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type circuitState struct {
+	Failures  int       `json:"failures"`
+	OpenUntil time.Time `json:"open_until"`
+}
+
+// fetchWithCircuitBreaker skips fetching while the circuit is open and
+// reports up=0 instead. the circuit opens after CircuitBreakerThreshold
+// consecutive failures and stays open for CircuitBreakerCooldown.
+func (p *Plugin) fetchWithCircuitBreaker() (map[string]float64, error) {
+	path := p.stateFile("circuit")
+	state := circuitState{}
+	if err := p.loadState(path, &state); err != nil {
+		log.Printf("circuit breaker state (ignore): %v", err)
+	}
+
+	now := time.Now()
+	if now.Before(state.OpenUntil) {
+		return map[string]float64{"up": 0}, nil
+	}
+
+	result, err := p.fetchMetrics()
+	if err != nil {
+		state.Failures++
+		opened := state.Failures >= p.CircuitBreakerThreshold
+		if opened {
+			state.OpenUntil = now.Add(p.CircuitBreakerCooldown)
+		}
+		if serr := p.saveState(path, state); serr != nil {
+			log.Printf("circuit breaker state: %v", serr)
+		}
+		if opened {
+			log.Printf("circuit breaker opened after %d failures: %v", state.Failures, err)
+			return map[string]float64{"up": 0}, nil
+		}
+		return nil, err
+	}
+
+	if state.Failures > 0 || !state.OpenUntil.IsZero() {
+		if err := p.saveState(path, circuitState{}); err != nil {
+			log.Printf("circuit breaker state: %v", err)
+		}
+	}
+	result["up"] = 1
+	return result, nil
+}
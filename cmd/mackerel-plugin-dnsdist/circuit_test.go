@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(testStats))
+	}))
+	defer ts.Close()
+
+	p := newTestPlugin(t, ts.URL)
+	p.CircuitBreaker = true
+	p.CircuitBreakerThreshold = 2
+	p.CircuitBreakerCooldown = time.Hour
+
+	// the first failure is returned as is
+	if _, err := p.fetchWithCircuitBreaker(); err == nil {
+		t.Fatal("expected an error before the circuit opens")
+	}
+	// the second failure opens the circuit
+	m, err := p.fetchWithCircuitBreaker()
+	if err != nil || m["up"] != 0 {
+		t.Fatalf("expected up=0 when the circuit opens, got %v %v", m, err)
+	}
+	// fetching is skipped while the circuit is open
+	atomic.StoreInt32(&failing, 0)
+	before := atomic.LoadInt32(&requests)
+	m, err = p.fetchWithCircuitBreaker()
+	if err != nil || m["up"] != 0 {
+		t.Fatalf("expected up=0 while the circuit is open, got %v %v", m, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != before {
+		t.Errorf("fetched %d times while the circuit is open", n-before)
+	}
+
+	// recovers once the cooldown has passed
+	path := p.stateFile("circuit")
+	if err := p.saveState(path, circuitState{Failures: 2, OpenUntil: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	m, err = p.fetchWithCircuitBreaker()
+	if err != nil || m["up"] != 1 || m["queries"] != 100 {
+		t.Fatalf("expected up=1 after recovery, got %v %v", m, err)
+	}
+	state := circuitState{}
+	if err := p.loadState(path, &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Failures != 0 || !state.OpenUntil.IsZero() {
+		t.Errorf("state is not reset after recovery: %+v", state)
+	}
+}
+
+func TestStateFileArgs(t *testing.T) {
+	p := newTestPlugin(t, "http://127.0.0.1:8083")
+	a := *p
+	a.Args = []string{"--only-backend", "a"}
+	b := *p
+	b.Args = []string{"--only-backend", "b"}
+	if a.stateFile("flaps") == b.stateFile("flaps") {
+		t.Error("instances with different arguments share a state file")
+	}
+	// the scheme may change with --scheme auto
+	c := a
+	c.URL = "https://127.0.0.1:8083/jsonstat?command=stats"
+	if a.stateFile("flaps") != c.stateFile("flaps") {
+		t.Error("state file changes with the scheme")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+)
+
+type configState struct {
+	Generation string  `json:"generation"`
+	Reloads    float64 `json:"reloads"`
+}
+
+// configGeneration identifies the configuration of the rule chain. dnsdist
+// has no generation counter, so it is a hash of the rules.
+func configGeneration(api *serversAPI) string {
+	h := sha1.New()
+	for _, r := range api.Rules {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\n", r.str("uuid"), r.str("rule"), r.str("action"))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// configChanged reports whether the generation differs from the previous run
+// and the number of changes observed so far
+func (p *Plugin) configChanged(api *serversAPI) (bool, float64) {
+	path := p.stateFile("config")
+	state := configState{}
+	if err := p.loadState(path, &state); err != nil {
+		log.Printf("config state (ignore): %v", err)
+	}
+	gen := configGeneration(api)
+	if gen == state.Generation {
+		return false, state.Reloads
+	}
+	changed := state.Generation != ""
+	if changed {
+		state.Reloads++
+	}
+	state.Generation = gen
+	if err := p.saveState(path, state); err != nil {
+		log.Printf("config state: %v", err)
+	}
+	return changed, state.Reloads
+}
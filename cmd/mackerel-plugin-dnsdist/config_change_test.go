@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+const (
+	testRules        = `{"rules": [{"id": 0, "uuid": "a", "rule": "qname==example.com.", "action": "drop"}]}`
+	testChangedRules = `{"rules": [{"id": 0, "uuid": "a", "rule": "qname==example.com.", "action": "drop"}, {"id": 1, "uuid": "b", "rule": "all", "action": "delay by 100 ms"}]}`
+)
+
+func TestConfigChanged(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", RuleMetrics: true, WorkDir: t.TempDir()}
+	for i, tt := range []struct {
+		rules string
+		want  float64
+	}{
+		// nothing to compare with on the first run
+		{testRules, 0},
+		{testRules, 0},
+		{testChangedRules, 1},
+		// emitted only once
+		{testChangedRules, 0},
+	} {
+		m := p.serversAPIMetrics(parseServersAPI(t, tt.rules))
+		if got, ok := m["config-changed"]; !ok || got != tt.want {
+			t.Errorf("run %d: config-changed got %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestConfigReloads(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", RuleMetrics: true, WorkDir: t.TempDir()}
+	for i, tt := range []struct {
+		rules string
+		want  float64
+	}{
+		{testRules, 0},
+		{testChangedRules, 1},
+		{testChangedRules, 1},
+		{testRules, 2},
+		{`{"rules": []}`, 3},
+		{`{"rules": []}`, 3},
+	} {
+		m := p.serversAPIMetrics(parseServersAPI(t, tt.rules))
+		if got, ok := m["config-reloads"]; !ok || got != tt.want {
+			t.Errorf("run %d: config-reloads got %v, want %v", i, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+type counterSnapshot struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// deltaSinceLastRun saves cur to the named state file and returns the
+// increase of each counter since the previous run. counters that are new or
+// seem to be reset are omitted. ok is false on the first run.
+func (p *Plugin) deltaSinceLastRun(name string, cur map[string]float64) (map[string]float64, time.Duration, bool) {
+	path := p.stateFile(name)
+	last := counterSnapshot{}
+	if err := p.loadState(path, &last); err != nil {
+		log.Printf("%s state (ignore): %v", name, err)
+	}
+	now := time.Now()
+	if err := p.saveState(path, counterSnapshot{Time: now, Values: cur}); err != nil {
+		log.Printf("%s state: %v", name, err)
+	}
+	if last.Values == nil || !now.After(last.Time) {
+		return nil, 0, false
+	}
+
+	deltas := map[string]float64{}
+	for k, v := range cur {
+		lv, ok := last.Values[k]
+		if !ok || v < lv {
+			continue
+		}
+		deltas[k] = v - lv
+	}
+	return deltas, now.Sub(last.Time), true
+}
+
+func percentage(n, total float64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return n / total * 100
+}
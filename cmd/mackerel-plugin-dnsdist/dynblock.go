@@ -0,0 +1,36 @@
+package main
+
+// dynBlocksExpiringSoon is the remaining duration (in seconds) of a dynamic
+// block to be counted as expiring soon
+const dynBlocksExpiringSoon = 60
+
+func (p *Plugin) fetchDynBlocks() (map[string]apiObject, error) {
+	blocks := map[string]apiObject{}
+	if err := p.fetchJSON(p.DynBlockURL, p.statsTimeout(), &blocks); err != nil {
+		return nil, err
+	}
+	return blocks, nil
+}
+
+// dynBlockMetrics returns the number of blocks expiring soon and the
+// longest remaining duration, which is 0 when there are no blocks
+func dynBlockMetrics(blocks map[string]apiObject) map[string]float64 {
+	expiring := 0.0
+	longest := 0.0
+	for _, b := range blocks {
+		sec, ok := b.number("seconds")
+		if !ok {
+			continue
+		}
+		if sec <= dynBlocksExpiringSoon {
+			expiring++
+		}
+		if sec > longest {
+			longest = sec
+		}
+	}
+	return map[string]float64{
+		"dynblocks-expiring-soon":            expiring,
+		"dynblock-longest-remaining-seconds": longest,
+	}
+}
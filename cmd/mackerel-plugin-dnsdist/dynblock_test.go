@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testDynBlocks = `{
+	"192.0.2.1/32": {"reason": "Exceeded query rate", "seconds": 10, "blocks": 3, "action": "Drop", "ebpf": false, "warning": false},
+	"192.0.2.2/32": {"reason": "Exceeded query rate", "seconds": 60, "blocks": 0, "action": "Drop", "ebpf": false, "warning": false},
+	"2001:db8::/64": {"reason": "Exceeded servfail rate", "seconds": 300, "blocks": 8, "action": "Refused", "ebpf": false, "warning": false}
+}`
+
+func TestDynBlockMetrics(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("command") == "dynblocklist" {
+			w.Write([]byte(testDynBlocks))
+			return
+		}
+		w.Write([]byte(testStats))
+	}))
+	defer ts.Close()
+
+	p := newTestPlugin(t, ts.URL)
+	p.DynBlocks = true
+	m, err := p.fetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["dynblocks-expiring-soon"] != 2 {
+		t.Errorf("dynblocks-expiring-soon: got %v, want 2", m["dynblocks-expiring-soon"])
+	}
+}
+
+func TestDynBlockLongestRemaining(t *testing.T) {
+	for fixture, want := range map[string]float64{
+		testDynBlocks: 300,
+		`{}`:          0,
+		// entries without a duration are ignored
+		`{"192.0.2.1/32": {"reason": "manual"}}`: 0,
+	} {
+		blocks := map[string]apiObject{}
+		if err := json.Unmarshal([]byte(fixture), &blocks); err != nil {
+			t.Fatal(err)
+		}
+		m := dynBlockMetrics(blocks)
+		if got, ok := m["dynblock-longest-remaining-seconds"]; !ok || got != want {
+			t.Errorf("%s: got %v, want %v", fixture, got, want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+type backendFlap struct {
+	Up       bool      `json:"up"`
+	Flaps    float64   `json:"flaps"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+type flapState struct {
+	Backends map[string]backendFlap `json:"backends"`
+}
+
+// backendFlaps counts how many times each backend switched between up and
+// down across runs. ups maps backend keys to whether they are up now.
+// backends not seen in this run are kept for StateFileTTL, so that the count
+// survives a backend briefly missing from the servers API.
+func (p *Plugin) backendFlaps(ups map[string]bool) map[string]float64 {
+	path := p.stateFile("flaps")
+	state := flapState{}
+	if err := p.loadState(path, &state); err != nil {
+		log.Printf("flaps state (ignore): %v", err)
+	}
+
+	now := time.Now()
+	cur := flapState{Backends: map[string]backendFlap{}}
+	for key, f := range state.Backends {
+		if _, ok := ups[key]; !ok && now.Sub(f.LastSeen) < p.StateFileTTL {
+			cur.Backends[key] = f
+		}
+	}
+	result := map[string]float64{}
+	for key, up := range ups {
+		f := backendFlap{Up: up, LastSeen: now}
+		if last, ok := state.Backends[key]; ok {
+			f.Flaps = last.Flaps
+			if last.Up != up {
+				f.Flaps++
+			}
+		}
+		cur.Backends[key] = f
+		result[key+".flaps"] = f.Flaps
+	}
+	if err := p.saveState(path, cur); err != nil {
+		log.Printf("flaps state: %v", err)
+	}
+	return result
+}
+
+func backendUp(s apiObject) bool {
+	return strings.EqualFold(s.str("state"), "up")
+}
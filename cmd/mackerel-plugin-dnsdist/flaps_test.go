@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackendFlaps(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir()}
+	for i, tt := range []struct {
+		b1    bool
+		flaps float64
+	}{
+		{true, 0},
+		{false, 1},
+		{false, 1},
+		{true, 2},
+		{false, 3},
+	} {
+		m := p.backendFlaps(map[string]bool{"backend.b1": tt.b1, "backend.b2": true})
+		if m["backend.b1.flaps"] != tt.flaps {
+			t.Errorf("run %d: backend.b1.flaps got %v, want %v", i, m["backend.b1.flaps"], tt.flaps)
+		}
+		if v, ok := m["backend.b2.flaps"]; !ok || v != 0 {
+			t.Errorf("run %d: backend.b2.flaps got %v, want 0", i, v)
+		}
+	}
+}
+
+func TestBackendFlapsServersAPI(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir()}
+	var m map[string]float64
+	for _, state := range []string{"up", "down", "UP"} {
+		api := parseServersAPI(t, `{"servers": [{"name": "b1", "address": "192.0.2.1:53", "state": "`+state+`"}]}`)
+		m = p.backendMetrics(api.Servers)
+	}
+	if m["backend.b1.flaps"] != 2 {
+		t.Errorf("backend.b1.flaps: got %v, want 2", m["backend.b1.flaps"])
+	}
+}
+
+func TestBackendFlapsTTL(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir(), StateFileTTL: 30 * time.Minute}
+	now := time.Now()
+	if err := p.saveState(p.stateFile("flaps"), flapState{Backends: map[string]backendFlap{
+		"backend.recent": {Up: false, Flaps: 3, LastSeen: now.Add(-10 * time.Minute)},
+		"backend.stale":  {Up: false, Flaps: 5, LastSeen: now.Add(-time.Hour)},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	p.backendFlaps(map[string]bool{"backend.b1": true})
+
+	state := flapState{}
+	if err := p.loadState(p.stateFile("flaps"), &state); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state.Backends["backend.stale"]; ok {
+		t.Error("backend.stale is kept after StateFileTTL")
+	}
+	if f, ok := state.Backends["backend.recent"]; !ok || f.Flaps != 3 {
+		t.Errorf("backend.recent got %+v, want to be kept", f)
+	}
+
+	// the count survives the backend missing for a run
+	m := p.backendFlaps(map[string]bool{"backend.b1": true, "backend.recent": true})
+	if m["backend.recent.flaps"] != 4 {
+		t.Errorf("backend.recent.flaps: got %v, want 4", m["backend.recent.flaps"])
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "regexp"
+
+var flattenSeparatorRegexp = regexp.MustCompile(`^[-a-zA-Z0-9_.]+$`)
+
+// flatten expands nested objects of jsonstat into keys joined by sep, such
+// as {"doh": {"queries": 1}} into doh.queries with sep "."
+func flatten(t map[string]interface{}, sep string) map[string]interface{} {
+	result := map[string]interface{}{}
+	for k, v := range t {
+		nested, ok := v.(map[string]interface{})
+		if !ok {
+			result[k] = v
+			continue
+		}
+		for nk, nv := range flatten(nested, sep) {
+			result[k+sep+nk] = nv
+		}
+	}
+	return result
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFlatten(t *testing.T) {
+	ts, _ := newTestServer(t, `{"queries": 100, "doh": {"queries": 10, "http": {"200": 9}}, "version": {"name": "dnsdist"}}`)
+	for sep, want := range map[string][]string{
+		".":  {"doh.queries", "doh.http.200"},
+		"_":  {"doh_queries", "doh_http_200"},
+		"-":  {"doh-queries", "doh-http-200"},
+		"__": {"doh__queries", "doh__http__200"},
+	} {
+		p := newTestPlugin(t, ts.URL)
+		p.Flatten = true
+		p.FlattenSep = sep
+		m, err := p.fetchMetrics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m[want[0]] != 10 || m[want[1]] != 9 || m["queries"] != 100 {
+			t.Errorf("--flatten-sep %q: got %v", sep, m)
+		}
+		// non-numeric leaves are ignored as before
+		for k := range m {
+			if strings.HasPrefix(k, "version") {
+				t.Errorf("--flatten-sep %q: %s is emitted", sep, k)
+			}
+		}
+	}
+}
+
+func TestFlattenSepValidation(t *testing.T) {
+	for _, sep := range []string{".", "_", "-", "__"} {
+		opt := Opt{Scheme: "http", OutputFormat: "mackerel", Flatten: true, FlattenSep: sep}
+		if problems := validateConfig(&opt); len(problems) > 0 {
+			t.Errorf("%q: unexpected problems %v", sep, problems)
+		}
+	}
+	for _, sep := range []string{"", "/", " ", ":", "#", "*"} {
+		opt := Opt{Scheme: "http", OutputFormat: "mackerel", Flatten: true, FlattenSep: sep}
+		problems := validateConfig(&opt)
+		if len(problems) != 1 || !strings.Contains(problems[0], "invalid flatten separator") {
+			t.Errorf("%q: got %v", sep, problems)
+		}
+	}
+}
@@ -1,94 +1,396 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jessevdk/go-flags"
 	mp "github.com/mackerelio/go-mackerel-plugin"
+	"golang.org/x/net/proxy"
 	"golang.org/x/text/cases"
 	"golang.org/x/text/language"
 )
 
 const (
-	StatusCodeOK      = 0
-	StatusCodeWARNING = 1
+	StatusCodeOK       = 0
+	StatusCodeWARNING  = 1
+	StatusCodeCRITICAL = 2
+	StatusCodeUNKNOWN  = 3
 )
 
 // version by Makefile
 var version string
 
 type Opt struct {
-	Version bool   `short:"v" long:"version" description:"Show version"`
-	Prefix  string `long:"prefix" default:"dnsdist" description:"Metric key prefix"`
+	Version     bool   `short:"v" long:"version" description:"Show version"`
+	Prefix      string `long:"prefix" default:"dnsdist" description:"Metric key prefix"`
+	GraphSuffix string `long:"graph-suffix" description:"Suffix appended to each graph key to separate graphs of multiple instances"`
 
-	Port    string        `short:"p" long:"port" default:"8083" description:"Port number"`
-	Host    string        `short:"H" long:"hostname" default:"127.0.0.1" description:"Hostname"`
-	Timeout time.Duration `long:"timeout" default:"30s" description:"Timeout"`
+	StripKeyPrefix string `long:"strip-key-prefix" description:"Prefix removed from jsonstat keys, for builds reporting keys such as dnsdist_queries"`
+	Flatten        bool   `long:"flatten" description:"Flatten nested objects in jsonstat instead of ignoring them"`
+	FlattenSep     string `long:"flatten-sep" default:"." description:"Separator joining keys of nested objects with --flatten"`
 
-	APIKey string `long:"api-key" description:"api key"`
+	AssertMinMetrics        int `long:"assert-min-metrics" description:"Fail when fewer numeric metrics than this are parsed from jsonstat"`
+	DropMetricsOnErrorCount int `long:"drop-metrics-on-error-count" description:"Fail when more fields than this in jsonstat cannot be parsed as numbers"`
+
+	Scheme       string        `long:"scheme" default:"http" env:"DNSDIST_SCHEME" choice:"http" choice:"https" choice:"auto" description:"Scheme. auto tries https and falls back to http"`
+	Port         string        `short:"p" long:"port" default:"8083" description:"Port number"`
+	Host         string        `short:"H" long:"hostname" default:"127.0.0.1" description:"Hostname"`
+	StatsURL     string        `long:"url" description:"URL of jsonstat stats. overrides --scheme, --hostname and --port. the servers API and the health path are requested under the same directory. user:password@ is sent as basic auth"`
+	Timeout      time.Duration `long:"timeout" default:"30s" description:"Timeout"`
+	StatsTimeout time.Duration `long:"stats-timeout" description:"Timeout for jsonstat. defaults to --timeout"`
+	APITimeout   time.Duration `long:"api-timeout" description:"Timeout for the servers API. defaults to --timeout"`
+	ReadTimeout  time.Duration `long:"read-timeout" description:"Timeout for reading the response body after headers are received"`
+	PreResolve   bool          `long:"pre-resolve" description:"Resolve the hostname before fetching to report hostnames without addresses clearly"`
+	Insecure     bool          `long:"insecure" env:"DNSDIST_INSECURE" description:"Skip verification of the server certificate with https"`
+
+	CanonicalizeHost bool `long:"canonicalize-host" description:"Log the canonical name (CNAME target) and the addresses of the hostname. the Host header is not changed"`
+
+	FallbackDelay time.Duration `long:"fallback-delay" description:"Delay before racing the other address family when connecting to dual-stack hosts (Happy Eyeballs). defaults to 300ms"`
+
+	Retry         int           `long:"retry" default:"0" description:"Number of retries on failure"`
+	RetryInterval time.Duration `long:"retry-interval" default:"1s" description:"Interval between retries"`
+	NoRetryOn5xx  bool          `long:"no-retry-on-5xx" description:"Do not retry when dnsdist or a proxy returns 5xx"`
+
+	APIKey []string `long:"api-key" description:"api key. can be specified multiple times or comma-separated to try each in order on key rotation"`
+
+	SOCKS5         string `long:"socks5" description:"Fetch through a SOCKS5 proxy (host:port)"`
+	SOCKS5User     string `long:"socks5-user" description:"Username for the SOCKS5 proxy"`
+	SOCKS5Password string `long:"socks5-password" description:"Password for the SOCKS5 proxy"`
+
+	DumpRaw string `long:"dump-raw" description:"Save the raw jsonstat response to the file for bug reports"`
+	PostTo  string `long:"post-to" description:"Also POST the metrics as JSON to the URL, for debugging custom collectors"`
+
+	ListBackends bool `long:"list-backends" description:"Print backends in the servers API and exit"`
+
+	ValidateConfig bool `long:"validate-config" description:"Check the options, print the effective configuration and exit"`
+
+	ErrorJSON bool `long:"error-json" description:"Print fetch errors to stderr as a JSON object"`
+	Trace     bool `long:"trace" description:"Log time spent in DNS, connect, TLS handshake and the first byte of each request to stderr"`
+
+	OutputFormat string `long:"output-format" default:"mackerel" choice:"mackerel" choice:"json" choice:"prometheus" choice:"openmetrics" description:"Output format of fetched metrics"`
+	JSON         bool   `long:"json" hidden:"true" description:"Same as --output-format json"`
+	OpenMetrics  bool   `long:"openmetrics" hidden:"true" description:"Same as --output-format openmetrics"`
+
+	Check            bool    `long:"check" description:"Check the health of dnsdist instead of emitting metrics"`
+	WarnServfailRate float64 `long:"warn-servfail-rate" description:"Servfail rate (%) to return WARNING in --check mode"`
+	CritServfailRate float64 `long:"crit-servfail-rate" description:"Servfail rate (%) to return CRITICAL in --check mode"`
+
+	HealthEndpointCheck bool   `long:"health-endpoint-check" description:"Check that the health path returns 200 with JSON instead of emitting metrics. works without jsonstat"`
+	HealthPath          string `long:"health-path" default:"/api/v1/servers/localhost" description:"Path requested by --health-endpoint-check"`
+
+	DynBlocks       bool `long:"dynblocks" description:"Fetch the dynamic block list and emit dynamic block metrics"`
+	ServersAPI      bool `long:"servers-api" description:"Fetch the servers API and emit all of rule, backend, frontend and pool metrics"`
+	RuleMetrics     bool `long:"rule-metrics" description:"Fetch rules from the servers API and emit rule metrics"`
+	BackendMetrics  bool `long:"backend-metrics" description:"Fetch backends from the servers API and emit per-backend metrics"`
+	FrontendMetrics bool `long:"frontend-metrics" description:"Fetch frontends from the servers API and emit frontend metrics"`
+	PoolMetrics     bool `long:"pool-metrics" description:"Fetch pools from the servers API and emit per-pool metrics"`
+
+	OnlyBackends []string `long:"only-backend" description:"Emit per-backend metrics only for the backend (name or address). can be specified multiple times"`
+	OnlyPools    []string `long:"only-pool" description:"Emit per-entity metrics only for the pool and its backends. can be specified multiple times"`
+	ZeroOnRemove bool     `long:"zero-on-remove" description:"Emit 0 once for per-entity metrics of removed backends, frontends and pools"`
+
+	PrefixFromBackend bool `long:"prefix-from-backend" description:"Emit per-backend metrics under graphs of each backend (<prefix>.<backend>.*) instead of backend.#. implies --backend-metrics. adds graphs for every backend"`
+
+	MinQueriesForBackend float64 `long:"min-queries-for-backend" description:"Omit per-backend metrics of backends with fewer queries than this since the previous run"`
+
+	AbortOnPartialServersAPI bool `long:"abort-on-partial-servers-api" description:"Fail when backends in the servers API lack fields of per-backend metrics"`
+	BackendLatencyBuckets    bool `long:"backend-latency-buckets" description:"Emit per-backend latency buckets with --backend-metrics when dnsdist reports them"`
+
+	OnConflict string `long:"on-conflict" default:"error" choice:"error" choice:"first" choice:"last" choice:"sum" description:"How to merge derived metrics whose key already exists"`
+
+	Thresholds []string `long:"threshold" description:"Emit <key>-over as 1 when the metric exceeds the value (key:value). counters graphed as Diff are compared as cumulative totals, not per interval. can be specified multiple times"`
+
+	MetricConfig string `long:"metric-config" description:"JSON file overriding diff, stacked, label, unit or the name of metrics in graphs"`
+
+	RuleRate     bool `long:"rule-rate" description:"Emit the share (%) of queries dropped or answered by rules since the previous run"`
+	AnswerSource bool `long:"answer-source" description:"Emit the share (%) of answers by dnsdist itself and by backends since the previous run"`
+
+	CacheRatioWindow int `long:"cache-ratio-window" description:"Emit cache hit ratio smoothed over the last N runs"`
+
+	WorkDir       string `long:"work-dir" description:"Directory of state files. defaults to MACKEREL_PLUGIN_WORKDIR or the temp dir. the API key read from dnsdist.conf is cached only when this is a private (0700) directory"`
+	CompressState bool   `long:"compress-state" description:"Gzip state files"`
+
+	StateFileTTL time.Duration `long:"state-file-ttl" description:"Keep state of backends missing from the servers API for this duration before pruning"`
+
+	CircuitBreaker          bool          `long:"circuit-breaker" description:"Skip fetching for a while after consecutive failures"`
+	CircuitBreakerThreshold int           `long:"circuit-breaker-threshold" default:"3" description:"Number of consecutive failures to open the circuit"`
+	CircuitBreakerCooldown  time.Duration `long:"circuit-breaker-cooldown" default:"5m" description:"Duration to skip fetching once the circuit is open"`
 }
 
-func (o *Opt) URL() string {
-	url := url.URL{
-		Scheme:   "http",
-		Host:     net.JoinHostPort(o.Host, o.Port),
-		Path:     "/jsonstat",
-		RawQuery: "command=stats",
+// outputFormat returns the output format. --json and --openmetrics are kept
+// for compatibility.
+func (o *Opt) outputFormat() string {
+	switch {
+	case o.JSON:
+		return "json"
+	case o.OpenMetrics:
+		return "openmetrics"
 	}
-	return url.String()
+	return o.OutputFormat
 }
 
-var apiKeyRegexp = regexp.MustCompile(`setWebserverConfig\(.*\{.*\bapiKey\s*=\s*"(.+?)"`)
+// scheme returns the scheme of URLs. https is tried first with --scheme auto.
+func (o *Opt) scheme() string {
+	if o.Scheme == "auto" {
+		return "https"
+	}
+	return o.Scheme
+}
 
-func (o *Opt) GetAPIKey() string {
-	if o.APIKey != "" {
-		return o.APIKey
+// impliedFlags enables the metrics implied by --prefix-from-backend and
+// --servers-api.
+func (o *Opt) impliedFlags() {
+	if o.PrefixFromBackend {
+		o.BackendMetrics = true
+	}
+	if o.ServersAPI {
+		o.RuleMetrics = true
+		o.BackendMetrics = true
+		o.FrontendMetrics = true
+		o.PoolMetrics = true
 	}
-	buf, err := os.ReadFile("/etc/dnsdist/dnsdist.conf")
+}
+
+// parseStatsURL parses --url. userinfo is kept for basicAuth.
+func parseStatsURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
 	if err != nil {
-		return ""
+		// url.Error quotes the input, which may carry the password
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("invalid url: %w", err)
 	}
-	res := apiKeyRegexp.FindAllSubmatch(buf, -1)
-	if len(res) < 1 {
-		return ""
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url: %s", u.Redacted())
 	}
-	return string(res[0][1])
+	return u, nil
+}
+
+// endpoint returns the scheme, the host:port and the base path of dnsdist.
+// --url overrides --scheme, --hostname and --port, and the directory of its
+// path is the base path, for dnsdist behind a reverse proxy with a path
+// prefix such as https://proxy/dnsdist/jsonstat.
+func (o *Opt) endpoint() (string, string, string) {
+	if o.StatsURL != "" {
+		if u, err := parseStatsURL(o.StatsURL); err == nil {
+			base := ""
+			if u.Path != "" {
+				base = strings.TrimSuffix(path.Dir(u.Path), "/")
+			}
+			return u.Scheme, u.Host, base
+		}
+	}
+	return o.scheme(), net.JoinHostPort(o.Host, o.Port), ""
+}
+
+// basicAuth returns the credentials embedded in --url
+func (o *Opt) basicAuth() (string, string) {
+	u, err := parseStatsURL(o.StatsURL)
+	if err != nil || u.User == nil {
+		return "", ""
+	}
+	password, _ := u.User.Password()
+	return u.User.Username(), password
+}
+
+func (o *Opt) jsonstatURL(command string) string {
+	scheme, host, base := o.endpoint()
+	url := url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     base + "/jsonstat",
+		RawQuery: "command=" + command,
+	}
+	return url.String()
+}
+
+func (o *Opt) URL() string {
+	if o.StatsURL != "" {
+		if u, err := parseStatsURL(o.StatsURL); err == nil {
+			u.User = nil
+			return u.String()
+		}
+	}
+	return o.jsonstatURL("stats")
+}
+
+func (o *Opt) DynBlockURL() string {
+	return o.jsonstatURL("dynblocklist")
+}
+
+func (o *Opt) ServersURL() string {
+	scheme, host, base := o.endpoint()
+	url := url.URL{
+		Scheme: scheme,
+		Host:   host,
+		Path:   base + "/api/v1/servers/localhost",
+	}
+	return url.String()
 }
 
+func (o *Opt) HealthURL() string {
+	scheme, host, base := o.endpoint()
+	return scheme + "://" + host + base + "/" + strings.TrimPrefix(o.HealthPath, "/")
+}
+
+var graphSuffixRegexp = regexp.MustCompile(`^[-a-zA-Z0-9_]+$`)
+
 type Plugin struct {
-	Prefix  string
-	URL     string
-	Timeout time.Duration
-	APIKey  string
+	Prefix       string
+	GraphSuffix  string
+	URL          string
+	ServersURL   string
+	DynBlockURL  string
+	HealthURL    string
+	Timeout      time.Duration
+	StatsTimeout time.Duration
+	APITimeout   time.Duration
+	ReadTimeout  time.Duration
+	PreResolve   bool
+	SchemeAuto   bool
+	Insecure     bool
+	APIKey       string
+	APIKeys      []string
+
+	FallbackDelay time.Duration
+
+	CanonicalizeHost bool
+
+	BasicAuthUser     string
+	BasicAuthPassword string
+
+	StripKeyPrefix string
+	Flatten        bool
+	FlattenSep     string
+
+	AssertMinMetrics        int
+	DropMetricsOnErrorCount int
+
+	Retry         int
+	RetryInterval time.Duration
+	NoRetryOn5xx  bool
+
+	SOCKS5         string
+	SOCKS5User     string
+	SOCKS5Password string
+
+	ErrorJSON bool
+	Trace     bool
+	DumpRaw   string
+	PostTo    string
+
+	DynBlocks       bool
+	RuleMetrics     bool
+	BackendMetrics  bool
+	FrontendMetrics bool
+	PoolMetrics     bool
+
+	OnlyBackends []string
+	OnlyPools    []string
+	ZeroOnRemove bool
+
+	PrefixFromBackend bool
+
+	MinQueriesForBackend float64
+
+	AbortOnPartialServersAPI bool
+	BackendLatencyBuckets    bool
+
+	OnConflict string
+
+	Thresholds map[string]float64
+
+	MetricConfig *metricConfig
+
+	RuleRate     bool
+	AnswerSource bool
+
+	CacheRatioWindow int
+
+	WorkDir       string
+	CompressState bool
+
+	// command line arguments, to separate state files of instances
+	Args []string
+
+	StateFileTTL time.Duration
+
+	CircuitBreaker          bool
+	CircuitBreakerThreshold int
+	CircuitBreakerCooldown  time.Duration
+
+	// the servers API fetched by fetchMetrics, for graph definitions
+	servers *serversAPI
+	// resolver for --pre-resolve and --canonicalize-host. nil uses
+	// net.DefaultResolver
+	resolver *net.Resolver
 }
 
-func (p *Plugin) httpClient() *http.Client {
+// dialer returns the dialer of httpClient. zero FallbackDelay leaves the
+// Go default of 300ms.
+func (p *Plugin) dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout:       timeout,
+		KeepAlive:     timeout,
+		FallbackDelay: p.FallbackDelay,
+	}
+}
+
+func (p *Plugin) httpClient(timeout time.Duration) (*http.Client, error) {
+	dialer := p.dialer(timeout)
 	transport := &http.Transport{
 		// inherited http.DefaultTransport
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   p.Timeout,
-			KeepAlive: p.Timeout,
-		}).DialContext,
-		TLSHandshakeTimeout:   p.Timeout,
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
 		ExpectContinueTimeout: 1 * time.Second,
-		ResponseHeaderTimeout: p.Timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+	if p.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	if p.SOCKS5 != "" {
+		var auth *proxy.Auth
+		if p.SOCKS5User != "" {
+			auth = &proxy.Auth{User: p.SOCKS5User, Password: p.SOCKS5Password}
+		}
+		d, err := proxy.SOCKS5("tcp", p.SOCKS5, auth, dialer)
+		if err != nil {
+			return nil, err
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("socks5 dialer does not support context")
+		}
+		transport.Proxy = nil
+		transport.DialContext = cd.DialContext
 	}
 	return &http.Client{
 		Transport: transport,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
-	}
+	}, nil
 }
 
 func (p *Plugin) MetricKeyPrefix() string {
@@ -98,9 +400,32 @@ func (p *Plugin) MetricKeyPrefix() string {
 	return p.Prefix
 }
 
+func (p *Plugin) labelPrefix() string {
+	return cases.Title(language.Und, cases.NoLower).String(p.Prefix)
+}
+
 func (p *Plugin) GraphDefinition() map[string]mp.Graphs {
-	labelPrefix := cases.Title(language.Und, cases.NoLower).String(p.Prefix)
-	return map[string]mp.Graphs{
+	graphs := p.graphDefinition()
+	if p.PrefixFromBackend {
+		p.addBackendGraphs(graphs)
+	}
+	if p.MetricConfig != nil {
+		// validated in main
+		p.MetricConfig.apply(graphs)
+	}
+	if p.GraphSuffix != "" {
+		suffixed := map[string]mp.Graphs{}
+		for k, g := range graphs {
+			suffixed[p.suffixGraphKey(k)] = g
+		}
+		graphs = suffixed
+	}
+	return graphs
+}
+
+func (p *Plugin) graphDefinition() map[string]mp.Graphs {
+	labelPrefix := p.labelPrefix()
+	graphs := map[string]mp.Graphs{
 		"acl-drop": {
 			Label: labelPrefix + ": Dropped packets becaused of the ACL",
 			Unit:  "integer",
@@ -116,6 +441,42 @@ func (p *Plugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "cache-misses", Label: "Misses", Stacked: true, Diff: true},
 			},
 		},
+		"cache-deferred": {
+			Label: labelPrefix + ": Packet Cache deferred operations",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache-deferred-inserts", Label: "Deferred inserts", Diff: true},
+				{Name: "cache-deferred-lookups", Label: "Deferred lookups", Diff: true},
+			},
+		},
+		"cache-negative": {
+			Label: labelPrefix + ": Packet Cache negative entries",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache-negative-entries", Label: "Entries"},
+			},
+		},
+		"cache-prefetch": {
+			Label: labelPrefix + ": Packet Cache prefetches",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache-prefetch", Label: "Prefetched", Diff: true},
+			},
+		},
+		"cache-stale": {
+			Label: labelPrefix + ": Packet Cache stale hits",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache-stale-hits", Label: "Stale hits", Diff: true},
+			},
+		},
+		"cache-not-cached": {
+			Label: labelPrefix + ": Packet Cache uncacheable responses",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache-not-cached", Label: "Not cached", Diff: true},
+			},
+		},
 		"downstream-errors": {
 			Label: labelPrefix + ": Backend errors",
 			Unit:  "integer",
@@ -134,6 +495,14 @@ func (p *Plugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "latency-avg1000000", Label: "Latency1000000"},
 			},
 		},
+		"packet-size": {
+			Label: labelPrefix + ": Average packet size",
+			Unit:  "bytes",
+			Metrics: []mp.Metrics{
+				{Name: "avg-query-size", Label: "Query"},
+				{Name: "avg-response-size", Label: "Response"},
+			},
+		},
 		"queries": {
 			Label: labelPrefix + ": Queries",
 			Unit:  "integer",
@@ -162,6 +531,77 @@ func (p *Plugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "rule-truncated", Label: "Truncated", Stacked: true, Diff: true},
 			},
 		},
+		"tcp-unavailable-drops": {
+			Label: labelPrefix + ": Queries dropped because TCP is unavailable",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "tcp-unavailable-drops", Label: "Dropped", Diff: true},
+			},
+		},
+		"tc-retried-tcp": {
+			Label: labelPrefix + ": Truncated queries retried over TCP",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "tc-retried-tcp", Label: "Retried", Diff: true},
+			},
+		},
+		"dnstap": {
+			Label: labelPrefix + ": Dnstap messages",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "dnstap-sent", Label: "Sent", Diff: true},
+				{Name: "dnstap-dropped", Label: "Dropped", Diff: true},
+			},
+		},
+		"response-rules-evaluated": {
+			Label: labelPrefix + ": Responses evaluated by response rules",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "response-rules-evaluated", Label: "Evaluated", Diff: true},
+			},
+		},
+		"rule-errors": {
+			Label: labelPrefix + ": Rule processing errors",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "rule-errors", Label: "Errors", Diff: true},
+			},
+		},
+		"remote-log-queue": {
+			Label: labelPrefix + ": Remote logger queue",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "remote-log-queue", Label: "Queued"},
+			},
+		},
+		"remote-log-drops": {
+			Label: labelPrefix + ": Remote logger drops",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "remote-log-drops", Label: "Dropped", Diff: true},
+			},
+		},
+		"response-rate-limited": {
+			Label: labelPrefix + ": Responses dropped by rate limiting",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "response-rate-limited", Label: "Dropped", Diff: true},
+			},
+		},
+		"webserver-connections": {
+			Label: labelPrefix + ": Webserver connections",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "webserver-connections", Label: "Connections"},
+			},
+		},
+		"plugin-version": {
+			Label: labelPrefix + ": Plugin version",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "plugin-version", Label: "Version"},
+			},
+		},
 		"fd": {
 			Label: labelPrefix + ": FD usage",
 			Unit:  "integer",
@@ -169,44 +609,646 @@ func (p *Plugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "fd-usage", Label: "usage"},
 			},
 		},
+		"doh-status": {
+			Label: labelPrefix + ": DoH responses by HTTP status",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true, Diff: true},
+			},
+		},
+		"pipe-full": {
+			Label: labelPrefix + ": Internal pipe full events",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true, Diff: true},
+			},
+		},
+		"doq": {
+			Label: labelPrefix + ": DoQ",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Diff: true},
+			},
+		},
+		"edns-options": {
+			Label: labelPrefix + ": Queries with EDNS options",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Diff: true},
+			},
+		},
+		"opcode": {
+			Label: labelPrefix + ": Queries by opcode",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true, Diff: true},
+			},
+		},
+		"edns-version": {
+			Label: labelPrefix + ": Queries by EDNS version",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true, Diff: true},
+			},
+		},
+		"response-rcode": {
+			Label: labelPrefix + ": Responses by rcode",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true, Diff: true},
+			},
+		},
+		"cache-entries-by-type": {
+			Label: labelPrefix + ": Cache Entries by Type",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true},
+			},
+		},
+		"self-answered-rcode": {
+			Label: labelPrefix + ": Self answered by rcode",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true, Diff: true},
+			},
+		},
 	}
+	if p.RuleRate {
+		graphs["rule-rate"] = mp.Graphs{
+			Label: labelPrefix + ": Returned because of rules per query",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "rule-rate-drop", Label: "Drop"},
+				{Name: "rule-rate-nxdomain", Label: "Nxdomain"},
+				{Name: "rule-rate-refused", Label: "Refused"},
+			},
+		}
+	}
+	if p.AnswerSource {
+		graphs["answer-source"] = mp.Graphs{
+			Label: labelPrefix + ": Answered by",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "answer-source-self", Label: "Self", Stacked: true},
+				{Name: "answer-source-backend", Label: "Backend", Stacked: true},
+			},
+		}
+	}
+	if p.CacheRatioWindow > 0 {
+		graphs["cache-ratio"] = mp.Graphs{
+			Label: labelPrefix + ": Packet Cache hit ratio",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "cache-hit-ratio-smoothed", Label: "Smoothed hit ratio"},
+			},
+		}
+	}
+	if p.DynBlocks {
+		graphs["dynblocks"] = mp.Graphs{
+			Label: labelPrefix + ": Dynamic blocks",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "dynblocks-expiring-soon", Label: "Expiring within a minute"},
+			},
+		}
+		graphs["dynblock-remaining"] = mp.Graphs{
+			Label: labelPrefix + ": Dynamic block remaining time",
+			Unit:  "seconds",
+			Metrics: []mp.Metrics{
+				{Name: "dynblock-longest-remaining-seconds", Label: "Longest remaining"},
+			},
+		}
+	}
+	if p.needServersAPI() {
+		graphs["discovered"] = mp.Graphs{
+			Label: labelPrefix + ": Discovered entities",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#"},
+			},
+		}
+	}
+	if p.RuleMetrics {
+		graphs["rule-config"] = mp.Graphs{
+			Label: labelPrefix + ": Configured rules by action",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true},
+			},
+		}
+		graphs["lua-rules"] = mp.Graphs{
+			Label: labelPrefix + ": Lua rules",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "lua-rules-lua", Label: "Lua", Stacked: true},
+				{Name: "lua-rules-ffi", Label: "LuaFFI", Stacked: true},
+			},
+		}
+		graphs["rule-state"] = mp.Graphs{
+			Label: labelPrefix + ": Rules by state",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "rules-enabled", Label: "Enabled", Stacked: true},
+				{Name: "rules-disabled", Label: "Disabled", Stacked: true},
+			},
+		}
+		graphs["response-rule-action"] = mp.Graphs{
+			Label: labelPrefix + ": Response rule matches by action",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true, Diff: true},
+			},
+		}
+		graphs["cache-miss-rule"] = mp.Graphs{
+			Label: labelPrefix + ": Cache miss rule matches",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache-miss-rule-matches", Label: "Matches", Diff: true},
+			},
+		}
+		graphs["rule-chain"] = mp.Graphs{
+			Label: labelPrefix + ": Rule chain length",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "rule-chain-length", Label: "Rules"},
+				{Name: "response-rule-chain-length", Label: "Response rules"},
+			},
+		}
+		graphs["config"] = mp.Graphs{
+			Label: labelPrefix + ": Configuration changes",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "config-changed", Label: "Changed"},
+			},
+		}
+		graphs["config-reloads"] = mp.Graphs{
+			Label: labelPrefix + ": Configuration reloads observed",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "config-reloads", Label: "Reloads"},
+			},
+		}
+	}
+	if p.BackendMetrics {
+		graphs["cache-outage"] = mp.Graphs{
+			Label: labelPrefix + ": Packet Cache hits during backend outage",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache-hits-during-outage", Label: "Hits", Diff: true},
+			},
+		}
+		graphs["backend.#"] = mp.Graphs{
+			Label: labelPrefix + ": Backend",
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "load-vs-weight", Label: "Outstanding per weight"},
+				{Name: "pool-size", Label: "TCP connection pool size"},
+				{Name: "pool-in-use", Label: "TCP connections in use"},
+				{Name: "max-concurrent-connections", Label: "TCP peak concurrent connections"},
+				{Name: "queries-per-connection", Label: "TCP queries per connection"},
+				{Name: "weighted-qps", Label: "QPS per weight"},
+				{Name: "flaps", Label: "Up/down transitions"},
+			},
+		}
+		graphs["backend.#.rcode"] = mp.Graphs{
+			Label: labelPrefix + ": Backend Responses by rcode",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "noerror", Label: "Noerror", Diff: true},
+				{Name: "nxdomain", Label: "Nxdomain", Diff: true},
+				{Name: "servfail", Label: "Servfail", Diff: true},
+				{Name: "refused", Label: "Refused", Diff: true},
+			},
+		}
+		if p.BackendLatencyBuckets {
+			graphs["backend.#.latency-bucket"] = mp.Graphs{
+				Label: labelPrefix + ": Backend Latency Buckets",
+				Unit:  "integer",
+				Metrics: []mp.Metrics{
+					{Name: "#", Stacked: true, Diff: true},
+				},
+			}
+		}
+	}
+	if p.PoolMetrics {
+		graphs["pool.#"] = mp.Graphs{
+			Label: labelPrefix + ": Pool Packet Cache",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "cache-hits", Label: "Hits", Diff: true},
+				{Name: "cache-misses", Label: "Misses", Diff: true},
+				{Name: "cache-entries", Label: "Entries"},
+				{Name: "cache-memory", Label: "Memory (bytes)"},
+			},
+		}
+	}
+	if p.FrontendMetrics {
+		graphs["frontend-state"] = mp.Graphs{
+			Label: labelPrefix + ": Frontends",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "frontends-active", Label: "Active", Stacked: true},
+				{Name: "frontends-paused", Label: "Paused", Stacked: true},
+			},
+		}
+		graphs["frontend.#"] = mp.Graphs{
+			Label: labelPrefix + ": Frontend",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "accept-errors", Label: "Accept errors", Diff: true},
+				{Name: "outstanding", Label: "Queries in flight"},
+			},
+		}
+		graphs["transport-share"] = mp.Graphs{
+			Label: labelPrefix + ": Queries by frontend protocol share",
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true},
+			},
+		}
+		graphs["protocol-queries"] = mp.Graphs{
+			Label: labelPrefix + ": Queries by frontend protocol",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true, Diff: true},
+			},
+		}
+		graphs["protocol-responses"] = mp.Graphs{
+			Label: labelPrefix + ": Responses by frontend protocol",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "#", Stacked: true, Diff: true},
+			},
+		}
+	}
+	if len(p.Thresholds) > 0 {
+		metrics := []mp.Metrics{}
+		for _, k := range p.thresholdKeys() {
+			metrics = append(metrics, mp.Metrics{Name: thresholdMetricName(k), Label: k + " over threshold"})
+		}
+		graphs["threshold"] = mp.Graphs{
+			Label:   labelPrefix + ": Over threshold",
+			Unit:    "integer",
+			Metrics: metrics,
+		}
+	}
+	if p.CircuitBreaker {
+		graphs["up"] = mp.Graphs{
+			Label: labelPrefix + ": Up",
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "up", Label: "Up"},
+			},
+		}
+	}
+	return graphs
+}
+
+// suffixGraphKey appends GraphSuffix to the first segment of a graph key.
+// metric keys of wildcard graphs start with their graph key, so they are
+// renamed in the same way.
+func (p *Plugin) suffixGraphKey(key string) string {
+	if i := strings.Index(key, "."); i >= 0 {
+		return key[:i] + "-" + p.GraphSuffix + key[i:]
+	}
+	return key + "-" + p.GraphSuffix
 }
 
 func (p *Plugin) FetchMetrics() (map[string]float64, error) {
-	req, err := http.NewRequest("GET", p.URL, nil)
+	var result map[string]float64
+	var err error
+	if p.CircuitBreaker {
+		result, err = p.fetchWithCircuitBreaker()
+	} else {
+		result, err = p.fetchMetrics()
+	}
 	if err != nil {
 		return nil, err
 	}
+	for k, v := range p.thresholdMetrics(result) {
+		result[k] = v
+	}
+	if p.PrefixFromBackend {
+		result = p.prefixFromBackend(result)
+	}
+	if p.MetricConfig != nil {
+		p.MetricConfig.rename(result)
+	}
+	if p.GraphSuffix != "" {
+		suffixed := map[string]float64{}
+		for k, v := range result {
+			if strings.Contains(k, ".") {
+				k = p.suffixGraphKey(k)
+			}
+			suffixed[k] = v
+		}
+		result = suffixed
+	}
+	if p.PostTo != "" {
+		// the sink is only for debugging. do not fail the emission.
+		if err := p.postMetrics(result); err != nil {
+			log.Printf("post metrics: %v", err)
+		}
+	}
+	return result, nil
+}
+
+// statusError is returned when dnsdist responds with a non-200 status
+type statusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s returned status %d", e.URL, e.StatusCode)
+}
+
+// retryable reports whether a failed fetch should be retried. every fetch is
+// an idempotent GET, so retrying is always safe. 5xx responses can be
+// excluded for proxies that return them as a cacheable state.
+func (p *Plugin) retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500 && !p.NoRetryOn5xx
+	}
+	return true
+}
+
+// statsTimeout is the timeout of jsonstat requests
+func (p *Plugin) statsTimeout() time.Duration {
+	if p.StatsTimeout > 0 {
+		return p.StatsTimeout
+	}
+	return p.Timeout
+}
+
+// apiTimeout is the timeout of the servers API, which can be slow on large
+// configurations
+func (p *Plugin) apiTimeout() time.Duration {
+	if p.APITimeout > 0 {
+		return p.APITimeout
+	}
+	return p.Timeout
+}
+
+func (p *Plugin) fetchJSON(u string, timeout time.Duration, v interface{}) error {
+	for i := 0; ; i++ {
+		err := p.fetchJSONOnce(u, timeout, v)
+		if err == nil || i >= p.Retry || !p.retryable(err) {
+			return err
+		}
+		log.Printf("retrying %s: %v", u, err)
+		time.Sleep(p.RetryInterval)
+	}
+}
+
+func (p *Plugin) fetchJSONOnce(u string, timeout time.Duration, v interface{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if p.Trace {
+		ctx = withTrace(ctx, u)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
 	if p.APIKey != "" {
 		req.Header.Add("X-API-Key", p.APIKey)
 	}
-	res, err := p.httpClient().Do(req)
+	if p.BasicAuthUser != "" {
+		req.SetBasicAuth(p.BasicAuthUser, p.BasicAuthPassword)
+	}
+	client, err := p.httpClient(timeout)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return &statusError{URL: u, StatusCode: res.StatusCode}
+	}
 
-	t := map[string]interface{}{}
-	decoder := json.NewDecoder(res.Body)
+	if p.ReadTimeout > 0 {
+		// ResponseHeaderTimeout does not cover reading the body
+		timer := time.AfterFunc(p.ReadTimeout, cancel)
+		defer timer.Stop()
+	}
+	readErr := func(err error) error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("reading response body of %s timed out after %s", u, p.ReadTimeout)
+		}
+		return err
+	}
+
+	var body io.Reader = res.Body
+	if p.DumpRaw != "" && u == p.URL {
+		// dump before decoding so that unparsable responses are kept
+		buf, err := io.ReadAll(res.Body)
+		if err != nil {
+			return readErr(err)
+		}
+		if err := os.WriteFile(p.DumpRaw, buf, 0644); err != nil {
+			return fmt.Errorf("failed to dump raw response: %w", err)
+		}
+		body = bytes.NewReader(buf)
+	}
+	decoder := json.NewDecoder(body)
 	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return readErr(err)
+	}
+	return nil
+}
+
+// preResolve resolves the hostname of URL unless it is an IP address
+// maxCNAMEHops bounds the CNAME chain followed by logCanonicalHost
+const maxCNAMEHops = 8
+
+func (p *Plugin) lookupResolver() *net.Resolver {
+	if p.resolver != nil {
+		return p.resolver
+	}
+	return net.DefaultResolver
+}
+
+func (p *Plugin) preResolve() error {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.statsTimeout())
+	defer cancel()
+	addrs, err := p.lookupResolver().LookupHost(ctx, host)
+	var dnsErr *net.DNSError
+	if len(addrs) == 0 && (err == nil || errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return fmt.Errorf("hostname %s resolved to no addresses", host)
+	}
+	return err
+}
+
+// logCanonicalHost logs the canonical name and the addresses of the
+// hostname. requests are still sent with the original hostname.
+func (p *Plugin) logCanonicalHost() {
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return
+	}
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.statsTimeout())
+	defer cancel()
+	r := p.lookupResolver()
+	cname, err := r.LookupCNAME(ctx, host)
+	if err != nil {
+		log.Printf("canonicalize %s: %v", host, err)
+		return
+	}
+	// the Go resolver returns the first target of a CNAME chain
+	for i := 0; i < maxCNAMEHops; i++ {
+		next, err := r.LookupCNAME(ctx, cname)
+		if err != nil || next == cname {
+			break
+		}
+		cname = next
+	}
+	addrs, err := r.LookupHost(ctx, cname)
+	if err != nil {
+		log.Printf("canonicalize %s: %s: %v", host, cname, err)
+		return
+	}
+	log.Printf("canonicalize %s: %s %s", host, cname, strings.Join(addrs, ","))
+}
 
-	if err := decoder.Decode(&t); err != nil {
+func (p *Plugin) fetchMetrics() (map[string]float64, error) {
+	if p.PreResolve {
+		if err := p.preResolve(); err != nil {
+			return nil, err
+		}
+	}
+	if p.CanonicalizeHost {
+		p.logCanonicalHost()
+	}
+
+	t := map[string]interface{}{}
+	err := p.withAPIKeys(func() error {
+		return p.fetchJSON(p.URL, p.statsTimeout(), &t)
+	})
+	if err != nil {
 		return nil, err
 	}
 
+	if p.Flatten {
+		t = flatten(t, p.FlattenSep)
+	}
 	result := map[string]float64{}
+	var invalid []string
 	for k, b := range t {
 		f, err := strconv.ParseFloat(fmt.Sprintf("%v", b), 64)
 		if err != nil {
+			invalid = append(invalid, k)
 			continue
 		}
-		result[k] = f
+		result[strings.TrimPrefix(k, p.StripKeyPrefix)] = f
+	}
+	if p.DropMetricsOnErrorCount > 0 && len(invalid) > p.DropMetricsOnErrorCount {
+		sort.Strings(invalid)
+		return nil, fmt.Errorf("%d fields in %s are not numbers: %s", len(invalid), p.URL, strings.Join(invalid, ", "))
+	}
+	if len(result) < p.AssertMinMetrics {
+		return nil, fmt.Errorf("only %d numeric metrics in %s, expected at least %d", len(result), p.URL, p.AssertMinMetrics)
+	}
+	if err := p.mergeMetrics(result, statsMetrics(result)); err != nil {
+		return nil, err
+	}
+	if p.RuleRate {
+		if err := p.mergeMetrics(result, p.ruleRateMetrics(result)); err != nil {
+			return nil, err
+		}
+	}
+	if p.AnswerSource {
+		if err := p.mergeMetrics(result, p.answerSourceMetrics(result)); err != nil {
+			return nil, err
+		}
+	}
+
+	if v, ok := versionNumber(version); ok {
+		result["plugin-version"] = v
+	}
+
+	if p.CacheRatioWindow > 0 {
+		if ratio, ok := p.smoothedCacheHitRatio(result); ok {
+			result["cache-hit-ratio-smoothed"] = ratio
+		}
+	}
+
+	if p.DynBlocks {
+		blocks, err := p.fetchDynBlocks()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.mergeMetrics(result, dynBlockMetrics(blocks)); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.needServersAPI() {
+		api, err := p.fetchServersAPI()
+		if err != nil {
+			return nil, err
+		}
+		p.servers = api
+		if p.AbortOnPartialServersAPI && p.BackendMetrics {
+			if err := p.checkBackendFields(api.Servers); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.mergeMetrics(result, p.serversAPIMetrics(api)); err != nil {
+			return nil, err
+		}
+		if p.BackendMetrics {
+			if v, ok := p.cacheHitsDuringOutage(result, api.Servers); ok {
+				result["cache-hits-during-outage"] = v
+			}
+		}
+		if p.ZeroOnRemove {
+			p.zeroRemovedEntities(result)
+		}
 	}
 	return result, nil
 }
 
+// fetchedPlugin returns metrics fetched in advance
+type fetchedPlugin struct {
+	*Plugin
+	metrics map[string]float64
+}
+
+func (f *fetchedPlugin) FetchMetrics() (map[string]float64, error) {
+	return f.metrics, nil
+}
+
 func (u *Plugin) Run() {
-	plugin := mp.NewMackerelPlugin(u)
+	var p mp.PluginWithPrefix = u
+	if u.ErrorJSON && os.Getenv("MACKEREL_AGENT_PLUGIN_META") == "" {
+		// mackerel-plugin logs errors as text. fetch in advance to write
+		// them as JSON.
+		m, err := u.FetchMetrics()
+		if err != nil {
+			writeErrorJSON(os.Stderr, u.URL, err)
+			os.Exit(StatusCodeWARNING)
+		}
+		p = &fetchedPlugin{Plugin: u, metrics: m}
+	}
+	plugin := mp.NewMackerelPlugin(p)
 	plugin.Run()
 }
 
@@ -229,11 +1271,172 @@ Compiler: %s %s
 		os.Exit(StatusCodeWARNING)
 	}
 
+	opt.impliedFlags()
+
+	if opt.ValidateConfig {
+		if problems := validateConfig(&opt); len(problems) > 0 {
+			for _, problem := range problems {
+				fmt.Fprintf(os.Stderr, "%s\n", problem)
+			}
+			os.Exit(StatusCodeWARNING)
+		}
+		writeConfig(os.Stdout, &opt)
+		os.Exit(StatusCodeOK)
+	}
+
+	if opt.StatsURL != "" {
+		if _, err := parseStatsURL(opt.StatsURL); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(StatusCodeWARNING)
+		}
+	}
+
+	if opt.GraphSuffix != "" && !graphSuffixRegexp.MatchString(opt.GraphSuffix) {
+		fmt.Fprintf(os.Stderr, "invalid graph suffix: %s\n", opt.GraphSuffix)
+		os.Exit(StatusCodeWARNING)
+	}
+
+	if opt.Flatten && !flattenSeparatorRegexp.MatchString(opt.FlattenSep) {
+		fmt.Fprintf(os.Stderr, "invalid flatten separator: %q\n", opt.FlattenSep)
+		os.Exit(StatusCodeWARNING)
+	}
+
+	thresholds, err := parseThresholds(opt.Thresholds)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(StatusCodeWARNING)
+	}
+
 	u := &Plugin{
-		Prefix:  opt.Prefix,
-		Timeout: opt.Timeout,
-		URL:     opt.URL(),
-		APIKey:  opt.GetAPIKey(),
+		Prefix:       opt.Prefix,
+		GraphSuffix:  opt.GraphSuffix,
+		Timeout:      opt.Timeout,
+		StatsTimeout: opt.StatsTimeout,
+		APITimeout:   opt.APITimeout,
+		ReadTimeout:  opt.ReadTimeout,
+		PreResolve:   opt.PreResolve,
+		SchemeAuto:   opt.Scheme == "auto" && opt.StatsURL == "",
+		Insecure:     opt.Insecure,
+
+		FallbackDelay: opt.FallbackDelay,
+
+		CanonicalizeHost: opt.CanonicalizeHost,
+
+		StripKeyPrefix: opt.StripKeyPrefix,
+		Flatten:        opt.Flatten,
+		FlattenSep:     opt.FlattenSep,
+
+		AssertMinMetrics:        opt.AssertMinMetrics,
+		DropMetricsOnErrorCount: opt.DropMetricsOnErrorCount,
+
+		Retry:         opt.Retry,
+		RetryInterval: opt.RetryInterval,
+		NoRetryOn5xx:  opt.NoRetryOn5xx,
+		URL:           opt.URL(),
+		ServersURL:    opt.ServersURL(),
+		DynBlockURL:   opt.DynBlockURL(),
+		HealthURL:     opt.HealthURL(),
+		APIKeys:       opt.apiKeys(),
+
+		SOCKS5:         opt.SOCKS5,
+		SOCKS5User:     opt.SOCKS5User,
+		SOCKS5Password: opt.SOCKS5Password,
+
+		ErrorJSON: opt.ErrorJSON,
+		Trace:     opt.Trace,
+		DumpRaw:   opt.DumpRaw,
+		PostTo:    opt.PostTo,
+
+		DynBlocks:       opt.DynBlocks,
+		RuleMetrics:     opt.RuleMetrics,
+		BackendMetrics:  opt.BackendMetrics,
+		FrontendMetrics: opt.FrontendMetrics,
+		PoolMetrics:     opt.PoolMetrics,
+
+		OnlyBackends: opt.OnlyBackends,
+		OnlyPools:    opt.OnlyPools,
+		ZeroOnRemove: opt.ZeroOnRemove,
+
+		PrefixFromBackend: opt.PrefixFromBackend,
+
+		MinQueriesForBackend: opt.MinQueriesForBackend,
+
+		AbortOnPartialServersAPI: opt.AbortOnPartialServersAPI,
+		BackendLatencyBuckets:    opt.BackendLatencyBuckets,
+
+		OnConflict: opt.OnConflict,
+
+		Thresholds: thresholds,
+
+		RuleRate:     opt.RuleRate,
+		AnswerSource: opt.AnswerSource,
+
+		CacheRatioWindow: opt.CacheRatioWindow,
+
+		WorkDir:       opt.WorkDir,
+		CompressState: opt.CompressState,
+
+		Args: os.Args[1:],
+
+		StateFileTTL: opt.StateFileTTL,
+
+		CircuitBreaker:          opt.CircuitBreaker,
+		CircuitBreakerThreshold: opt.CircuitBreakerThreshold,
+		CircuitBreakerCooldown:  opt.CircuitBreakerCooldown,
+	}
+	u.BasicAuthUser, u.BasicAuthPassword = opt.basicAuth()
+	if opt.MetricConfig != "" {
+		c, err := loadMetricConfig(opt.MetricConfig)
+		if err == nil {
+			err = c.apply(u.graphDefinition())
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(StatusCodeWARNING)
+		}
+		u.MetricConfig = c
+	}
+	if len(u.APIKeys) > 0 {
+		u.APIKey = u.APIKeys[0]
+	} else {
+		u.APIKey = u.cachedAPIKey(dnsdistConfigPath)
+	}
+	if opt.ListBackends {
+		if err := u.ListBackends(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(StatusCodeWARNING)
+		}
+		os.Exit(StatusCodeOK)
+	}
+	if opt.HealthEndpointCheck {
+		code, msg := u.HealthCheck()
+		fmt.Printf("%s %s: %s\n", u.MetricKeyPrefix(), statusLabels[code], msg)
+		os.Exit(code)
+	}
+	if opt.Check {
+		code, msg := u.Check(opt.WarnServfailRate, opt.CritServfailRate)
+		fmt.Printf("%s %s: %s\n", u.MetricKeyPrefix(), statusLabels[code], msg)
+		os.Exit(code)
+	}
+	if format := opt.outputFormat(); format != "mackerel" {
+		m, err := u.FetchMetrics()
+		if err != nil {
+			if u.ErrorJSON {
+				writeErrorJSON(os.Stderr, u.URL, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+			os.Exit(StatusCodeWARNING)
+		}
+		switch format {
+		case "json":
+			writeJSON(os.Stdout, m)
+		case "prometheus":
+			writePrometheus(os.Stdout, u.MetricKeyPrefix(), m)
+		case "openmetrics":
+			writeOpenMetrics(os.Stdout, u.MetricKeyPrefix(), m)
+		}
+		os.Exit(StatusCodeOK)
 	}
 	u.Run()
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// mergeMetrics adds derived metrics in src to dst. OnConflict decides what
+// happens when a key already exists: error, first (keep dst), last (take
+// src) or sum.
+func (p *Plugin) mergeMetrics(dst, src map[string]float64) error {
+	keys := make([]string, 0, len(src))
+	for k := range src {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := src[k]
+		old, ok := dst[k]
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		switch p.OnConflict {
+		case "first":
+		case "last":
+			dst[k] = v
+		case "sum":
+			dst[k] = old + v
+		default:
+			return fmt.Errorf("duplicate metric key: %s", k)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestMergeMetrics(t *testing.T) {
+	tests := []struct {
+		onConflict string
+		want       float64
+		wantErr    bool
+	}{
+		{onConflict: "error", wantErr: true},
+		{onConflict: "first", want: 1},
+		{onConflict: "last", want: 2},
+		{onConflict: "sum", want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.onConflict, func(t *testing.T) {
+			p := &Plugin{OnConflict: tt.onConflict}
+			dst := map[string]float64{"queries": 1, "responses": 5}
+			err := p.mergeMetrics(dst, map[string]float64{"queries": 2, "derived": 4})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dst["queries"] != tt.want {
+				t.Errorf("queries: got %v, want %v", dst["queries"], tt.want)
+			}
+			// keys without conflicts are merged as is
+			if dst["derived"] != 4 || dst["responses"] != 5 {
+				t.Errorf("unexpected metrics: %v", dst)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+// metricOverride overrides the definition of a metric in a graph. unset
+// fields are left as defined by the plugin.
+type metricOverride struct {
+	Graph   string `json:"graph"`
+	Name    string `json:"name"`
+	Rename  string `json:"rename"`
+	Label   string `json:"label"`
+	Unit    string `json:"unit"`
+	Diff    *bool  `json:"diff"`
+	Stacked *bool  `json:"stacked"`
+}
+
+// metricConfig is the file of --metric-config, such as
+//
+//	{"metrics": [{"graph": "queries", "name": "queries", "diff": false}]}
+type metricConfig struct {
+	Metrics []metricOverride `json:"metrics"`
+}
+
+var graphUnits = []string{"float", "integer", "percentage", "seconds", "milliseconds", "bytes", "bytes/sec", "bits/sec", "iops"}
+
+func loadMetricConfig(path string) (*metricConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	c := &metricConfig{}
+	if err := dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("invalid metric config %s: %w", path, err)
+	}
+	for i, o := range c.Metrics {
+		if err := o.validate(); err != nil {
+			return nil, fmt.Errorf("invalid metric config %s: metrics[%d]: %w", path, i, err)
+		}
+	}
+	return c, nil
+}
+
+func (o *metricOverride) validate() error {
+	if o.Graph == "" || o.Name == "" {
+		return fmt.Errorf("graph and name are required")
+	}
+	if o.Unit != "" && !contains(graphUnits, o.Unit) {
+		return fmt.Errorf("unknown unit %q", o.Unit)
+	}
+	if o.Rename != "" {
+		// the key of a metric in a wildcard graph depends on the graph key
+		if strings.Contains(o.Graph, "#") || o.Name == "#" {
+			return fmt.Errorf("rename is not supported for wildcard graphs")
+		}
+		if !graphSuffixRegexp.MatchString(o.Rename) {
+			return fmt.Errorf("invalid rename %q", o.Rename)
+		}
+	}
+	return nil
+}
+
+// apply overrides graphs. an error is returned when a graph or a metric is
+// not defined, or when a metric is renamed to the name of another metric.
+func (c *metricConfig) apply(graphs map[string]mp.Graphs) error {
+	for _, o := range c.Metrics {
+		g, ok := graphs[o.Graph]
+		if !ok {
+			return fmt.Errorf("metric config: graph %s is not defined", o.Graph)
+		}
+		if o.Rename != "" && o.Rename != o.Name {
+			if graph, ok := metricDefined(graphs, o.Rename); ok {
+				return fmt.Errorf("metric config: rename %s conflicts with metric %s in graph %s", o.Name, o.Rename, graph)
+			}
+		}
+		found := false
+		for i := range g.Metrics {
+			m := &g.Metrics[i]
+			if m.Name != o.Name {
+				continue
+			}
+			found = true
+			if o.Rename != "" {
+				m.Name = o.Rename
+			}
+			if o.Label != "" {
+				m.Label = o.Label
+			}
+			if o.Diff != nil {
+				m.Diff = *o.Diff
+			}
+			if o.Stacked != nil {
+				m.Stacked = *o.Stacked
+			}
+		}
+		if !found {
+			return fmt.Errorf("metric config: metric %s is not defined in graph %s", o.Name, o.Graph)
+		}
+		if o.Unit != "" {
+			g.Unit = o.Unit
+		}
+		graphs[o.Graph] = g
+	}
+	return nil
+}
+
+// metricDefined returns the graph defining a metric named name. metrics of
+// wildcard graphs are not matched as their keys depend on the graph key.
+func metricDefined(graphs map[string]mp.Graphs, name string) (string, bool) {
+	keys := make([]string, 0, len(graphs))
+	for key := range graphs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if strings.Contains(key, "#") {
+			continue
+		}
+		for _, m := range graphs[key].Metrics {
+			if m.Name == name {
+				return key, true
+			}
+		}
+	}
+	return "", false
+}
+
+// rename renames fetched metrics as the graph definition. a metric is not
+// renamed over a fetched metric of the same name, such as a stat not in any
+// graph.
+func (c *metricConfig) rename(metrics map[string]float64) {
+	for _, o := range c.Metrics {
+		if o.Rename == "" || o.Rename == o.Name {
+			continue
+		}
+		v, ok := metrics[o.Name]
+		if !ok {
+			continue
+		}
+		if _, ok := metrics[o.Rename]; ok {
+			log.Printf("metric config: %s is not renamed to %s, which is already fetched", o.Name, o.Rename)
+			continue
+		}
+		delete(metrics, o.Name)
+		metrics[o.Rename] = v
+	}
+}
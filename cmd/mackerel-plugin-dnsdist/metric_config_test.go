@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mp "github.com/mackerelio/go-mackerel-plugin"
+)
+
+func writeMetricConfig(t *testing.T, conf string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if err := os.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func findMetric(t *testing.T, g mp.Graphs, name string) mp.Metrics {
+	t.Helper()
+	for _, m := range g.Metrics {
+		if m.Name == name {
+			return m
+		}
+	}
+	t.Fatalf("metric %s is not defined in %v", name, g.Metrics)
+	return mp.Metrics{}
+}
+
+func TestMetricConfig(t *testing.T) {
+	c, err := loadMetricConfig(writeMetricConfig(t, `{"metrics": [
+		{"graph": "queries", "name": "queries", "rename": "queries-total", "label": "Total"},
+		{"graph": "cache", "name": "cache-hits", "diff": false, "unit": "float"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, _ := newTestServer(t, testStats)
+	p := newTestPlugin(t, ts.URL)
+	if err := c.apply(p.graphDefinition()); err != nil {
+		t.Fatal(err)
+	}
+	p.MetricConfig = c
+
+	graphs := p.GraphDefinition()
+	if m := findMetric(t, graphs["queries"], "queries-total"); m.Label != "Total" || !m.Diff {
+		t.Errorf("renamed metric: %+v", m)
+	}
+	if m := findMetric(t, graphs["cache"], "cache-hits"); m.Diff || !m.Stacked {
+		t.Errorf("un-Diffed metric: %+v", m)
+	}
+	if graphs["cache"].Unit != "float" {
+		t.Errorf("unit: got %s", graphs["cache"].Unit)
+	}
+	// other metrics are left as defined
+	if m := findMetric(t, graphs["cache"], "cache-misses"); !m.Diff {
+		t.Errorf("cache-misses: %+v", m)
+	}
+
+	m, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["queries"]; ok {
+		t.Error("queries is emitted under the old name")
+	}
+	if m["queries-total"] != 100 {
+		t.Errorf("queries-total: got %v", m["queries-total"])
+	}
+}
+
+func TestMetricConfigErrors(t *testing.T) {
+	for conf, want := range map[string]string{
+		`{"metrics": [{"graph": "queries"}]}`:                                     "required",
+		`{"metrics": [{"graph": "queries", "name": "queries", "unit": "x"}]}`:     "unknown unit",
+		`{"metrics": [{"graph": "doh-status", "name": "#", "rename": "x"}]}`:      "wildcard",
+		`{"metrics": [{"graph": "queries", "name": "queries", "rename": "a.b"}]}`: "invalid rename",
+		`{"metrics": [{"graph": "queries", "name": "queries", "typo": true}]}`:    "unknown field",
+	} {
+		_, err := loadMetricConfig(writeMetricConfig(t, conf))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", conf, err, want)
+		}
+	}
+
+	p := &Plugin{Prefix: "dnsdist"}
+	for conf, want := range map[string]string{
+		`{"metrics": [{"graph": "missing", "name": "queries"}]}`: "graph missing",
+		`{"metrics": [{"graph": "queries", "name": "missing"}]}`: "metric missing",
+		// renamed to an existing metric of the same or another graph
+		`{"metrics": [{"graph": "queries", "name": "queries", "rename": "responses"}]}`:  "conflicts with metric responses",
+		`{"metrics": [{"graph": "queries", "name": "queries", "rename": "cache-hits"}]}`: "conflicts with metric cache-hits",
+		`{"metrics": [
+			{"graph": "queries", "name": "queries", "rename": "total"},
+			{"graph": "queries", "name": "responses", "rename": "total"}
+		]}`: "conflicts with metric total in graph queries",
+	} {
+		c, err := loadMetricConfig(writeMetricConfig(t, conf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.apply(p.graphDefinition())
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", conf, err, want)
+		}
+	}
+}
+
+func TestMetricConfigRenameFetched(t *testing.T) {
+	c := &metricConfig{Metrics: []metricOverride{{Graph: "queries", Name: "queries", Rename: "queries-total"}}}
+	m := map[string]float64{"queries": 100, "queries-total": 5}
+	c.rename(m)
+	// a fetched metric is not overwritten
+	if m["queries"] != 100 || m["queries-total"] != 5 {
+		t.Errorf("got %v", m)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "log"
+
+type outageState struct {
+	Seen      bool    `json:"seen"`
+	CacheHits float64 `json:"cache_hits"`
+	Total     float64 `json:"total"`
+}
+
+// cacheHitsDuringOutage returns the cumulative number of cache hits during
+// intervals that ended with any backend down, to see how much the packet
+// cache covers for outages
+func (p *Plugin) cacheHitsDuringOutage(stats map[string]float64, servers []apiObject) (float64, bool) {
+	hits, ok := stats["cache-hits"]
+	if !ok {
+		return 0, false
+	}
+	down := false
+	for _, s := range servers {
+		if p.backendSelected(s) && !backendUp(s) {
+			down = true
+			break
+		}
+	}
+
+	path := p.stateFile("outage")
+	state := outageState{}
+	if err := p.loadState(path, &state); err != nil {
+		log.Printf("outage state (ignore): %v", err)
+	}
+	if state.Seen && down && hits >= state.CacheHits {
+		state.Total += hits - state.CacheHits
+	}
+	state.Seen = true
+	state.CacheHits = hits
+	if err := p.saveState(path, state); err != nil {
+		log.Printf("outage state: %v", err)
+	}
+	return state.Total, true
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestCacheHitsDuringOutage(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir()}
+	for i, tt := range []struct {
+		hits  float64
+		state string
+		want  float64
+	}{
+		// nothing to compare with on the first run
+		{100, "down", 0},
+		{150, "up", 0},
+		// hits of intervals ending with a backend down are added
+		{180, "down", 30},
+		{200, "down", 50},
+		{260, "up", 50},
+		// the counter is reset
+		{10, "down", 50},
+		{15, "down", 55},
+	} {
+		api := parseServersAPI(t, `{"servers": [
+			{"name": "b1", "address": "192.0.2.1:53", "state": "up"},
+			{"name": "b2", "address": "192.0.2.2:53", "state": "`+tt.state+`"}
+		]}`)
+		got, ok := p.cacheHitsDuringOutage(map[string]float64{"cache-hits": tt.hits}, api.Servers)
+		if !ok || got != tt.want {
+			t.Errorf("run %d: got %v, want %v", i, got, tt.want)
+		}
+	}
+
+	if _, ok := p.cacheHitsDuringOutage(map[string]float64{"queries": 1}, nil); ok {
+		t.Error("emitted without cache-hits")
+	}
+}
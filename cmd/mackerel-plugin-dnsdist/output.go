@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeJSON writes metrics as a JSON object. values are formatted without
+// exponents so that large counters stay readable.
+func writeJSON(w io.Writer, metrics map[string]float64) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("{")
+	for i, k := range sortedKeys(metrics) {
+		if i > 0 {
+			bw.WriteString(",")
+		}
+		key, err := json.Marshal(k)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(bw, "%s:%s", key, formatFloat(metrics[k]))
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+var openMetricsNameRegexp = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// openMetricsName maps a metric key to a valid OpenMetrics metric name
+func openMetricsName(prefix, key string) string {
+	name := openMetricsNameRegexp.ReplaceAllString(prefix+"_"+key, "_")
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// writeExposition writes metrics as lines of the metric name and the value
+// with the type typ. jsonstat does not tell counters from gauges.
+func writeExposition(w *bufio.Writer, prefix string, metrics map[string]float64, typ string) {
+	seen := map[string]bool{}
+	for _, k := range sortedKeys(metrics) {
+		name := openMetricsName(prefix, k)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		fmt.Fprintf(w, "# TYPE %s %s\n%s %s\n", name, typ, name, formatFloat(metrics[k]))
+	}
+}
+
+// writeOpenMetrics writes metrics in the OpenMetrics text format
+func writeOpenMetrics(w io.Writer, prefix string, metrics map[string]float64) error {
+	bw := bufio.NewWriter(w)
+	writeExposition(bw, prefix, metrics, "unknown")
+	bw.WriteString("# EOF\n")
+	return bw.Flush()
+}
+
+// writePrometheus writes metrics in the Prometheus text format, which has
+// untyped instead of unknown and no EOF marker
+func writePrometheus(w io.Writer, prefix string, metrics map[string]float64) error {
+	bw := bufio.NewWriter(w)
+	writeExposition(bw, prefix, metrics, "untyped")
+	return bw.Flush()
+}
+
+type errorOutput struct {
+	Error  string `json:"error"`
+	URL    string `json:"url"`
+	Status int    `json:"status"`
+}
+
+// writeErrorJSON writes err as a single line JSON object. status is 0 when
+// there was no response.
+func writeErrorJSON(w io.Writer, defaultURL string, err error) error {
+	out := errorOutput{Error: err.Error(), URL: defaultURL}
+	var se *statusError
+	var ue *url.Error
+	if errors.As(err, &se) {
+		out.URL = se.URL
+		out.Status = se.StatusCode
+	} else if errors.As(err, &ue) {
+		out.URL = ue.URL
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+// ListBackends prints the backends seen in the servers API as a table
+func (p *Plugin) ListBackends(w io.Writer) error {
+	var api *serversAPI
+	err := p.withAPIKeys(func() error {
+		var err error
+		api, err = p.fetchServersAPI()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tADDRESS\tSTATE\tQUERIES")
+	for _, s := range api.Servers {
+		queries, _ := s.number("queries")
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", s.str("name"), s.str("address"), s.str("state"), formatFloat(queries))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	metrics := map[string]float64{
+		"queries":       123456789012345678901,
+		"latency-avg":   0.5,
+		"ctrl\x00key":   1,
+		"line\u2028sep": 2,
+	}
+	var b bytes.Buffer
+	if err := writeJSON(&b, metrics); err != nil {
+		t.Fatal(err)
+	}
+	out := b.String()
+	if strings.Contains(out, "e+") {
+		t.Errorf("exponent in output: %s", out)
+	}
+	got := map[string]float64{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", out, err)
+	}
+	for k, v := range metrics {
+		if got[k] != v {
+			t.Errorf("%q: got %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestWriteErrorJSON(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+	p := newTestPlugin(t, ts.URL)
+	_, err := p.FetchMetrics()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	var b bytes.Buffer
+	if err := writeErrorJSON(&b, p.URL, err); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(b.String(), "\n") != 1 {
+		t.Errorf("not a single line: %q", b.String())
+	}
+	got := errorOutput{}
+	if err := json.Unmarshal(b.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.URL != p.URL || got.Status != http.StatusForbidden || got.Error == "" {
+		t.Errorf("unexpected error output: %+v", got)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	metrics := map[string]float64{"queries": 100, "doh-status.2xx": 5}
+	var b bytes.Buffer
+	if err := writePrometheus(&b, "dnsdist", metrics); err != nil {
+		t.Fatal(err)
+	}
+	want := "# TYPE dnsdist_doh_status_2xx untyped\ndnsdist_doh_status_2xx 5\n" +
+		"# TYPE dnsdist_queries untyped\ndnsdist_queries 100\n"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestWriteOpenMetrics(t *testing.T) {
+	metrics := map[string]float64{"queries": 100, "doh-status.2xx": 5}
+	var b bytes.Buffer
+	if err := writeOpenMetrics(&b, "dnsdist", metrics); err != nil {
+		t.Fatal(err)
+	}
+	want := "# TYPE dnsdist_doh_status_2xx unknown\ndnsdist_doh_status_2xx 5\n" +
+		"# TYPE dnsdist_queries unknown\ndnsdist_queries 100\n" +
+		"# EOF\n"
+	if b.String() != want {
+		t.Errorf("got %q, want %q", b.String(), want)
+	}
+}
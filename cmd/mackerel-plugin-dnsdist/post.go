@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// postMetrics POSTs metrics to PostTo in the same JSON format as --json
+func (p *Plugin) postMetrics(metrics map[string]float64) error {
+	var buf bytes.Buffer
+	if err := writeJSON(&buf, metrics); err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: p.Timeout}
+	res, err := client.Post(p.PostTo, "application/json", &buf)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned status %d", p.PostTo, res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPostTo(t *testing.T) {
+	received := make(chan map[string]float64, 1)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		m := map[string]float64{}
+		if err := json.Unmarshal(body, &m); err != nil {
+			t.Errorf("invalid JSON %q: %v", body, err)
+		}
+		received <- m
+	}))
+	defer sink.Close()
+
+	ts, _ := newTestServer(t, testStats)
+	p := newTestPlugin(t, ts.URL)
+	p.PostTo = sink.URL
+	m, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if len(got) != len(m) || got["queries"] != m["queries"] {
+			t.Errorf("posted %v, want %v", got, m)
+		}
+	default:
+		t.Fatal("metrics are not posted")
+	}
+}
+
+func TestPostToError(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	ts, _ := newTestServer(t, testStats)
+	for _, sink := range []string{failing.URL, closed.URL} {
+		p := newTestPlugin(t, ts.URL)
+		p.PostTo = sink
+		if err := p.postMetrics(map[string]float64{"queries": 1}); err == nil {
+			t.Errorf("%s: expected an error", sink)
+		}
+		// the emission does not fail
+		m, err := p.FetchMetrics()
+		if err != nil {
+			t.Errorf("%s: %v", sink, err)
+		}
+		if m["queries"] != 100 {
+			t.Errorf("%s: queries got %v", sink, m["queries"])
+		}
+	}
+}
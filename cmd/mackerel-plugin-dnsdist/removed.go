@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"strings"
+)
+
+// entityKeyPrefixes are the prefixes of per-entity metric keys
+var entityKeyPrefixes = []string{"backend.", "frontend.", "pool."}
+
+func isEntityKey(key string) bool {
+	for _, prefix := range entityKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type entityState struct {
+	Keys []string `json:"keys"`
+}
+
+// zeroRemovedEntities adds 0 for per-entity metrics that were emitted on the
+// previous run but are missing now, so that graphs of removed backends end
+// with 0 instead of a gap. each removed metric is zeroed only once.
+func (p *Plugin) zeroRemovedEntities(result map[string]float64) {
+	path := p.stateFile("entities")
+	state := entityState{}
+	if err := p.loadState(path, &state); err != nil {
+		log.Printf("entities state (ignore): %v", err)
+	}
+
+	cur := entityState{}
+	for k := range result {
+		if isEntityKey(k) {
+			cur.Keys = append(cur.Keys, k)
+		}
+	}
+	for _, k := range state.Keys {
+		if _, ok := result[k]; !ok {
+			result[k] = 0
+		}
+	}
+	if err := p.saveState(path, cur); err != nil {
+		log.Printf("entities state: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestZeroRemovedEntities(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", ZeroOnRemove: true, WorkDir: t.TempDir()}
+
+	p.zeroRemovedEntities(map[string]float64{
+		"queries":                     1,
+		"backend.b1.load-vs-weight":   2,
+		"backend.b2.load-vs-weight":   3,
+		"frontend.udp-192_0_2_1_53.x": 4,
+	})
+
+	// b2 and the frontend are removed
+	m := map[string]float64{
+		"queries":                   1,
+		"backend.b1.load-vs-weight": 2,
+	}
+	p.zeroRemovedEntities(m)
+	want := map[string]float64{
+		"queries":                     1,
+		"backend.b1.load-vs-weight":   2,
+		"backend.b2.load-vs-weight":   0,
+		"frontend.udp-192_0_2_1_53.x": 0,
+	}
+	if len(m) != len(want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+
+	// zeroed only once
+	m = map[string]float64{"backend.b1.load-vs-weight": 2}
+	p.zeroRemovedEntities(m)
+	if _, ok := m["backend.b2.load-vs-weight"]; ok {
+		t.Error("backend.b2.load-vs-weight is zeroed twice")
+	}
+}
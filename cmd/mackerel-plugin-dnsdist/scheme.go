@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/url"
+)
+
+type schemeState struct {
+	Scheme string `json:"scheme"`
+}
+
+func withScheme(u, scheme string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return u
+	}
+	parsed.Scheme = scheme
+	return parsed.String()
+}
+
+func (p *Plugin) setScheme(scheme string) {
+	p.URL = withScheme(p.URL, scheme)
+	p.ServersURL = withScheme(p.ServersURL, scheme)
+	p.DynBlockURL = withScheme(p.DynBlockURL, scheme)
+	p.HealthURL = withScheme(p.HealthURL, scheme)
+}
+
+// withSchemeAuto calls fetch with URLs of https and falls back to http when
+// https fails, if SchemeAuto is set. the scheme that worked is cached in a
+// state file and tried first on the next run. URLs are left set to the
+// working scheme for the following requests.
+func (p *Plugin) withSchemeAuto(fetch func() error) error {
+	if !p.SchemeAuto {
+		return fetch()
+	}
+	path := p.stateFile("scheme")
+	state := schemeState{}
+	if err := p.loadState(path, &state); err != nil {
+		log.Printf("scheme state (ignore): %v", err)
+	}
+	schemes := []string{"https", "http"}
+	if state.Scheme == "http" {
+		schemes = []string{"http", "https"}
+	}
+
+	var err error
+	for _, scheme := range schemes {
+		p.setScheme(scheme)
+		err = fetch()
+		if err == nil {
+			if scheme != state.Scheme {
+				if err := p.saveState(path, schemeState{Scheme: scheme}); err != nil {
+					log.Printf("scheme state: %v", err)
+				}
+			}
+			return nil
+		}
+		var se *statusError
+		if errors.As(err, &se) {
+			// dnsdist is reachable with this scheme
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newSchemeAutoPlugin returns a plugin with --scheme auto for the test server
+// at u
+func newSchemeAutoPlugin(t *testing.T, u string) *Plugin {
+	t.Helper()
+	p := newTestPlugin(t, withScheme(u, "https"))
+	p.HealthURL = withScheme(u, "https") + "/api/v1/servers/localhost"
+	p.SchemeAuto = true
+	p.Insecure = true
+	return p
+}
+
+func TestSchemeAutoFallback(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/jsonstat" {
+			w.Write([]byte(testStats))
+			return
+		}
+		w.Write([]byte(`{"servers": [{"name": "b1", "address": "192.0.2.1:53", "state": "up", "queries": 1}]}`))
+	}))
+	defer ts.Close()
+
+	p := newSchemeAutoPlugin(t, ts.URL)
+	m, err := p.fetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["queries"] != 100 {
+		t.Errorf("queries: got %v", m["queries"])
+	}
+	if !strings.HasPrefix(p.URL, "http://") || !strings.HasPrefix(p.ServersURL, "http://") {
+		t.Errorf("URLs are not switched to http: %s %s", p.URL, p.ServersURL)
+	}
+	state := schemeState{}
+	if err := p.loadState(p.stateFile("scheme"), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Scheme != "http" {
+		t.Errorf("cached scheme: got %q, want http", state.Scheme)
+	}
+
+	// other modes fall back as well
+	p = newSchemeAutoPlugin(t, ts.URL)
+	var b bytes.Buffer
+	if err := p.ListBackends(&b); err != nil {
+		t.Fatalf("--list-backends: %v", err)
+	}
+	if !strings.Contains(b.String(), "b1") {
+		t.Errorf("--list-backends: b1 is not listed in %s", b.String())
+	}
+	p = newSchemeAutoPlugin(t, ts.URL)
+	if code, msg := p.HealthCheck(); code != StatusCodeOK {
+		t.Errorf("--health-endpoint-check: %s", msg)
+	}
+}
+
+func TestSchemeAutoHTTPS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testStats))
+	}))
+	defer ts.Close()
+
+	p := newSchemeAutoPlugin(t, ts.URL)
+	if _, err := p.fetchMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(p.URL, "https://") {
+		t.Errorf("URL is switched from https: %s", p.URL)
+	}
+}
+
+func TestSchemeAutoStatusError(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	// dnsdist is reachable with https, so http is not tried
+	p := newSchemeAutoPlugin(t, ts.URL)
+	_, err := p.fetchMetrics()
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected 401, got %v", err)
+	}
+	if !strings.HasPrefix(p.URL, "https://") {
+		t.Errorf("URL is switched from https: %s", p.URL)
+	}
+}
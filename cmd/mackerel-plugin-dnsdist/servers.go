@@ -0,0 +1,536 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// apiObject is an element of the servers API arrays. fields differ between
+// dnsdist versions, so they are looked up dynamically.
+type apiObject map[string]interface{}
+
+func (o apiObject) number(key string) (float64, bool) {
+	switch v := o[key].(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// firstNumber returns the first field found in keys
+func (o apiObject) firstNumber(keys ...string) (float64, bool) {
+	for _, k := range keys {
+		if v, ok := o.number(k); ok {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+func (o apiObject) str(key string) string {
+	if s, ok := o[key].(string); ok {
+		return s
+	}
+	return ""
+}
+
+// serversAPI is the response of /api/v1/servers/localhost
+type serversAPI struct {
+	Servers   []apiObject `json:"servers"`
+	Frontends []apiObject `json:"frontends"`
+	Pools     []apiObject `json:"pools"`
+	Rules     []apiObject `json:"rules"`
+
+	ResponseRules  []apiObject `json:"response-rules"`
+	CacheMissRules []apiObject `json:"cache-miss-rules"`
+}
+
+func (p *Plugin) needServersAPI() bool {
+	return p.RuleMetrics || p.FrontendMetrics || p.BackendMetrics || p.PoolMetrics
+}
+
+func (p *Plugin) fetchServersAPI() (*serversAPI, error) {
+	api := &serversAPI{}
+	if err := p.fetchJSON(p.ServersURL, p.apiTimeout(), api); err != nil {
+		return nil, err
+	}
+	return api, nil
+}
+
+var metricKeySanitizeRegexp = regexp.MustCompile(`[^-a-zA-Z0-9_]+`)
+
+// sanitizeMetricKey makes s usable as a part of metric key
+func sanitizeMetricKey(s string) string {
+	return strings.Trim(metricKeySanitizeRegexp.ReplaceAllString(s, "_"), "_")
+}
+
+// ruleActionKey returns the action type from a rule's action description
+// such as "drop", "spoof in 192.0.2.1" or "delay by 100 ms"
+func ruleActionKey(action string) string {
+	fields := strings.Fields(strings.ToLower(action))
+	if len(fields) == 0 {
+		return "none"
+	}
+	key := sanitizeMetricKey(fields[0])
+	if key == "" {
+		return "none"
+	}
+	return key
+}
+
+// backendRcodes are the rcode fields reported per backend by some dnsdist
+// versions
+var backendRcodes = []string{"noerror", "nxdomain", "servfail", "refused"}
+
+// backendKey returns the metric key of a backend. the address is used when
+// the backend has no name.
+func backendKey(s apiObject) string {
+	if name := s.str("name"); name != "" {
+		return sanitizeMetricKey(name)
+	}
+	return addressKey(s.str("address"))
+}
+
+var addressKeyReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+// addressKey returns the metric key of an address such as 192.0.2.1:53 or
+// [2001:db8::1]:53. IPv6 addresses are canonicalized and every separator is
+// kept as "_", so that 2001:db8::1 and 2001:db8:1:: do not collide.
+func addressKey(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ""
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		host = addressKeyReplacer.Replace(ip.Unmap().WithZone("").String())
+	} else {
+		host = sanitizeMetricKey(host)
+	}
+	if port == "" {
+		return host
+	}
+	return host + "_" + sanitizeMetricKey(port)
+}
+
+// matches latency0-1, latency1-10, ..., latency-slow in the same buckets as
+// jsonstat, reported per backend by some builds
+var backendLatencyBucketRegexp = regexp.MustCompile(`^latency(\d+-\d+|-slow)$`)
+
+// backendLatencyBuckets returns the latency buckets of a backend keyed by
+// bucket name such as 0-1 or slow
+func backendLatencyBuckets(s apiObject) map[string]float64 {
+	result := map[string]float64{}
+	for k := range s {
+		m := backendLatencyBucketRegexp.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		if v, ok := s.number(k); ok {
+			result[strings.TrimPrefix(m[1], "-")] = v
+		}
+	}
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// poolSelected reports whether metrics of the pool should be emitted
+func (p *Plugin) poolSelected(name string) bool {
+	return len(p.OnlyPools) == 0 || contains(p.OnlyPools, name)
+}
+
+// backendSelected reports whether metrics of the backend should be emitted.
+// with --only-pool, a backend is selected when it belongs to one of the pools.
+func (p *Plugin) backendSelected(s apiObject) bool {
+	if len(p.OnlyBackends) > 0 && !contains(p.OnlyBackends, s.str("name")) && !contains(p.OnlyBackends, s.str("address")) {
+		return false
+	}
+	if len(p.OnlyPools) > 0 {
+		pools, _ := s["pools"].([]interface{})
+		for _, pool := range pools {
+			if name, ok := pool.(string); ok && p.poolSelected(name) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// queriesPerConnection returns TCP queries per new TCP connection of a
+// backend. the average reported by dnsdist is used when the TCP query count
+// is not available.
+func queriesPerConnection(s apiObject) (float64, bool) {
+	queries, qok := s.number("tcpQueries")
+	conns, cok := s.number("tcpNewConnections")
+	if qok && cok {
+		if conns == 0 {
+			return 0, true
+		}
+		return queries / conns, true
+	}
+	return s.number("tcpAvgQueriesPerConnection")
+}
+
+// frontendTransports maps the transport in parentheses of a frontend type,
+// such as "TCP (DNS over TLS)", to the protocol
+var frontendTransports = map[string]string{
+	"dns over tls":   "dot",
+	"dns over https": "doh",
+	"dns over quic":  "doq",
+}
+
+var frontendTransportRegexp = regexp.MustCompile(`\(([^)]+)\)`)
+
+// frontendProtocol returns the protocol of a frontend, such as udp, tcp, doh,
+// dot or doq. encrypted frontends are reported by their transport rather
+// than the socket type.
+func frontendProtocol(f apiObject) string {
+	typ := strings.ToLower(f.str("type"))
+	if m := frontendTransportRegexp.FindStringSubmatch(typ); m != nil {
+		if proto, ok := frontendTransports[strings.TrimSpace(m[1])]; ok {
+			return proto
+		}
+	}
+	if fields := strings.Fields(typ); len(fields) > 0 {
+		if key := sanitizeMetricKey(fields[0]); key != "" {
+			return key
+		}
+	}
+	if f["tcp"] == true {
+		return "tcp"
+	}
+	return "udp"
+}
+
+func frontendPaused(f apiObject) bool {
+	return f["paused"] == true || strings.EqualFold(f.str("state"), "paused")
+}
+
+// poolKey returns the metric key of a pool. the unnamed pool is "default".
+func poolKey(pool apiObject) string {
+	if key := sanitizeMetricKey(pool.str("name")); key != "" {
+		return key
+	}
+	return "default"
+}
+
+func (p *Plugin) poolMetrics(pools []apiObject) map[string]float64 {
+	result := map[string]float64{}
+	for _, pool := range pools {
+		if !p.poolSelected(pool.str("name")) {
+			continue
+		}
+		key := "pool." + poolKey(pool)
+		if v, ok := pool.number("cacheHits"); ok {
+			result[key+".cache-hits"] = v
+		}
+		if v, ok := pool.number("cacheMisses"); ok {
+			result[key+".cache-misses"] = v
+		}
+		if v, ok := pool.number("cacheEntries"); ok {
+			result[key+".cache-entries"] = v
+		}
+		if v, ok := pool.number("cacheMemory"); ok {
+			result[key+".cache-memory"] = v
+		}
+	}
+	return result
+}
+
+// frontendKey returns the metric key of a frontend. an address can be shared
+// by frontends of different protocols, so the protocol is prepended.
+// frontends of the same protocol and address, such as ones added with
+// reusePort, have the same key.
+func frontendKey(f apiObject) string {
+	return frontendProtocol(f) + "-" + addressKey(f.str("address"))
+}
+
+// acceptErrors returns the sum of accept() errors and TLS handshake failures
+// of a frontend
+func acceptErrors(f apiObject) (float64, bool) {
+	sum, found := f.firstNumber("acceptErrors", "tcpAcceptErrors")
+	for k := range f {
+		if strings.HasPrefix(k, "tlsHandshakeFailures") {
+			if v, ok := f.number(k); ok {
+				sum += v
+				found = true
+			}
+		}
+	}
+	return sum, found
+}
+
+func frontendMetrics(frontends []apiObject) map[string]float64 {
+	result := map[string]float64{
+		"frontends-active": 0,
+		"frontends-paused": 0,
+	}
+	for _, f := range frontends {
+		if frontendPaused(f) {
+			result["frontends-paused"]++
+		} else {
+			result["frontends-active"]++
+		}
+		proto := frontendProtocol(f)
+		if v, ok := f.number("queries"); ok {
+			result["protocol-queries."+proto] += v
+		}
+		if v, ok := f.number("responses"); ok {
+			result["protocol-responses."+proto] += v
+		}
+		// summed over frontends sharing the key
+		key := "frontend." + frontendKey(f)
+		if v, ok := acceptErrors(f); ok {
+			result[key+".accept-errors"] += v
+		}
+		if v, ok := f.number("outstanding"); ok {
+			result[key+".outstanding"] += v
+		}
+	}
+	return result
+}
+
+func (p *Plugin) backendMetrics(servers []apiObject) map[string]float64 {
+	result := map[string]float64{}
+	queries := map[string]float64{}
+	weights := map[string]float64{}
+	ups := map[string]bool{}
+	for _, s := range servers {
+		if !p.backendSelected(s) {
+			continue
+		}
+		key := "backend." + backendKey(s)
+		ups[key] = backendUp(s)
+		outstanding, ok := s.number("outstanding")
+		weight, wok := s.number("weight")
+		if ok && wok && weight > 0 {
+			result[key+".load-vs-weight"] = outstanding / weight
+		}
+		if q, ok := s.number("queries"); ok {
+			queries[key] = q
+			if wok && weight > 0 {
+				weights[key] = weight
+			}
+		}
+		if v, ok := s.number("tcpPoolSize"); ok {
+			result[key+".pool-size"] = v
+		}
+		// older versions only report the current and the peak number of
+		// TCP connections
+		if v, ok := s.firstNumber("tcpPoolInUse", "tcpCurrentConnections"); ok {
+			result[key+".pool-in-use"] = v
+		}
+		if v, ok := s.number("tcpMaxConcurrentConnections"); ok {
+			result[key+".max-concurrent-connections"] = v
+		}
+		if v, ok := queriesPerConnection(s); ok {
+			result[key+".queries-per-connection"] = v
+		}
+		for _, rcode := range backendRcodes {
+			if v, ok := s.number(rcode); ok {
+				result[key+".rcode."+rcode] = v
+			}
+		}
+		if p.BackendLatencyBuckets {
+			for bucket, v := range backendLatencyBuckets(s) {
+				result[key+".latency-bucket."+bucket] = v
+			}
+		}
+	}
+
+	// QPS since the previous run divided by weight
+	deltas, elapsed, ok := p.deltaSinceLastRun("backend-queries", queries)
+	if ok {
+		for key, d := range deltas {
+			if weight, ok := weights[key]; ok {
+				result[key+".weighted-qps"] = d / elapsed.Seconds() / weight
+			}
+		}
+	}
+	for k, v := range p.backendFlaps(ups) {
+		result[k] = v
+	}
+
+	// omit low-traffic backends. backends without a delta, such as on the
+	// first run, are kept.
+	if ok && p.MinQueriesForBackend > 0 {
+		for key, d := range deltas {
+			if d >= p.MinQueriesForBackend {
+				continue
+			}
+			for k := range result {
+				if strings.HasPrefix(k, key+".") {
+					delete(result, k)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// transportShareMetrics returns the share (%) of queries per frontend
+// protocol during the last interval
+func (p *Plugin) transportShareMetrics(metrics map[string]float64) map[string]float64 {
+	cur := map[string]float64{}
+	for k, v := range metrics {
+		if strings.HasPrefix(k, "protocol-queries.") {
+			cur[strings.TrimPrefix(k, "protocol-queries.")] = v
+		}
+	}
+	deltas, _, ok := p.deltaSinceLastRun("transport-share", cur)
+	if !ok {
+		return nil
+	}
+	total := 0.0
+	for _, d := range deltas {
+		total += d
+	}
+	result := map[string]float64{}
+	for proto, d := range deltas {
+		result["transport-share."+proto] = percentage(d, total)
+	}
+	return result
+}
+
+// backendFields are the fields per-backend metrics are derived from. each
+// entry lists alternative names of a field across dnsdist versions.
+// tcpPoolSize is left out as older versions have no equivalent.
+var backendFields = [][]string{
+	{"outstanding"},
+	{"weight"},
+	{"queries"},
+	{"tcpPoolInUse", "tcpCurrentConnections"},
+}
+
+// checkBackendFields returns an error listing the selected backends lacking
+// any of backendFields
+func (p *Plugin) checkBackendFields(servers []apiObject) error {
+	var incomplete []string
+	for _, s := range servers {
+		if !p.backendSelected(s) {
+			continue
+		}
+		var missing []string
+		for _, names := range backendFields {
+			if _, ok := s.firstNumber(names...); !ok {
+				missing = append(missing, strings.Join(names, "|"))
+			}
+		}
+		if len(missing) > 0 {
+			name := s.str("name")
+			if name == "" {
+				name = s.str("address")
+			}
+			incomplete = append(incomplete, fmt.Sprintf("%s (%s)", name, strings.Join(missing, ", ")))
+		}
+	}
+	if len(incomplete) > 0 {
+		return fmt.Errorf("servers API is incomplete: %s", strings.Join(incomplete, "; "))
+	}
+	return nil
+}
+
+// luaKind returns "ffi" for LuaFFI actions and selectors, such as "Lua FFI
+// script" and "Lua FFI per-thread script", and "lua" for plain Lua ones
+func luaKind(description string) string {
+	fields := strings.Fields(strings.ToLower(description))
+	switch {
+	case len(fields) >= 2 && fields[0] == "lua" && fields[1] == "ffi":
+		return "ffi"
+	case len(fields) >= 1 && fields[0] == "lua":
+		return "lua"
+	}
+	return ""
+}
+
+// ruleDisabled reports whether a rule is marked disabled
+func ruleDisabled(r apiObject) bool {
+	return r["disabled"] == true || r["enabled"] == false
+}
+
+func (p *Plugin) serversAPIMetrics(api *serversAPI) map[string]float64 {
+	result := map[string]float64{
+		"discovered.backends":  float64(len(api.Servers)),
+		"discovered.frontends": float64(len(api.Frontends)),
+		"discovered.pools":     float64(len(api.Pools)),
+	}
+	if p.RuleMetrics {
+		result["rules-enabled"] = 0
+		result["rules-disabled"] = 0
+		result["lua-rules-lua"] = 0
+		result["lua-rules-ffi"] = 0
+		for _, r := range api.Rules {
+			// a rule is counted once even if both its selector and its
+			// action are Lua. FFI takes precedence.
+			action, selector := luaKind(r.str("action")), luaKind(r.str("rule"))
+			switch {
+			case action == "ffi" || selector == "ffi":
+				result["lua-rules-ffi"]++
+			case action == "lua" || selector == "lua":
+				result["lua-rules-lua"]++
+			}
+			result["rule-config."+ruleActionKey(r.str("action"))]++
+			if ruleDisabled(r) {
+				result["rules-disabled"]++
+			} else {
+				result["rules-enabled"]++
+			}
+		}
+		for _, r := range api.ResponseRules {
+			if v, ok := r.number("matches"); ok {
+				result["response-rule-action."+ruleActionKey(r.str("action"))] += v
+			}
+		}
+		for _, r := range api.CacheMissRules {
+			if v, ok := r.number("matches"); ok {
+				result["cache-miss-rule-matches"] += v
+			}
+		}
+		result["rule-chain-length"] = float64(len(api.Rules))
+		result["response-rule-chain-length"] = float64(len(api.ResponseRules))
+		changed, reloads := p.configChanged(api)
+		result["config-changed"] = 0
+		if changed {
+			result["config-changed"] = 1
+		}
+		result["config-reloads"] = reloads
+	}
+	if p.BackendMetrics {
+		for k, v := range p.backendMetrics(api.Servers) {
+			result[k] = v
+		}
+	}
+	if p.PoolMetrics {
+		for k, v := range p.poolMetrics(api.Pools) {
+			result[k] = v
+		}
+	}
+	if p.FrontendMetrics {
+		for k, v := range frontendMetrics(api.Frontends) {
+			result[k] = v
+		}
+		for k, v := range p.transportShareMetrics(result) {
+			result[k] = v
+		}
+	}
+	return result
+}
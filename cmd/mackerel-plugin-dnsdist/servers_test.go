@@ -0,0 +1,727 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseServersAPI parses a servers API fixture as fetchJSON does
+func parseServersAPI(t *testing.T, fixture string) *serversAPI {
+	t.Helper()
+	api := &serversAPI{}
+	decoder := json.NewDecoder(strings.NewReader(fixture))
+	decoder.UseNumber()
+	if err := decoder.Decode(api); err != nil {
+		t.Fatal(err)
+	}
+	return api
+}
+
+func TestBackendRcodes(t *testing.T) {
+	api := parseServersAPI(t, `{"servers": [
+		{"name": "b1", "address": "192.0.2.1:53", "state": "up", "noerror": 10, "servfail": 2},
+		{"name": "b2", "address": "192.0.2.2:53", "state": "up"}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir()}
+	m := p.backendMetrics(api.Servers)
+	if m["backend.b1.rcode.noerror"] != 10 || m["backend.b1.rcode.servfail"] != 2 {
+		t.Errorf("rcodes of b1: %v", m)
+	}
+	for k := range m {
+		if strings.HasPrefix(k, "backend.b2.rcode.") {
+			t.Errorf("%s is emitted for a backend without rcodes", k)
+		}
+	}
+}
+
+func TestBackendPool(t *testing.T) {
+	api := parseServersAPI(t, `{"servers": [
+		{"name": "new", "address": "192.0.2.1:53", "tcpPoolSize": 8, "tcpPoolInUse": 2, "tcpMaxConcurrentConnections": 5},
+		{"name": "old", "address": "192.0.2.2:53", "tcpCurrentConnections": 3, "tcpMaxConcurrentConnections": 7}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir()}
+	m := p.backendMetrics(api.Servers)
+	want := map[string]float64{
+		"backend.new.pool-size":                  8,
+		"backend.new.pool-in-use":                2,
+		"backend.new.max-concurrent-connections": 5,
+		"backend.old.pool-in-use":                3,
+		"backend.old.max-concurrent-connections": 7,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+	// the peak is not a pool size
+	if _, ok := m["backend.old.pool-size"]; ok {
+		t.Errorf("backend.old.pool-size is emitted from tcpMaxConcurrentConnections")
+	}
+}
+
+func TestCheckBackendFields(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist"}
+	api := parseServersAPI(t, `{"servers": [
+		{"name": "new", "address": "192.0.2.1:53", "outstanding": 0, "weight": 1, "queries": 10, "tcpPoolSize": 8, "tcpPoolInUse": 2},
+		{"name": "old", "address": "192.0.2.2:53", "outstanding": 0, "weight": 1, "queries": 10, "tcpCurrentConnections": 3}
+	]}`)
+	if err := p.checkBackendFields(api.Servers); err != nil {
+		t.Errorf("complete backends: %v", err)
+	}
+
+	api = parseServersAPI(t, `{"servers": [
+		{"name": "new", "address": "192.0.2.1:53", "outstanding": 0, "weight": 1, "queries": 10, "tcpPoolInUse": 2},
+		{"name": "partial", "address": "192.0.2.2:53", "outstanding": 0, "queries": 10},
+		{"address": "192.0.2.3:53", "weight": 1, "queries": 10, "tcpPoolInUse": 2}
+	]}`)
+	err := p.checkBackendFields(api.Servers)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	want := "servers API is incomplete: partial (weight, tcpPoolInUse|tcpCurrentConnections); 192.0.2.3:53 (outstanding)"
+	if err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+}
+
+func TestFrontendMetrics(t *testing.T) {
+	api := parseServersAPI(t, `{"frontends": [
+		{"id": 0, "address": "[::1]:53", "type": "UDP", "acceptErrors": 1, "outstanding": 2},
+		{"id": 1, "address": "[1::]:53", "type": "UDP", "acceptErrors": 10, "outstanding": 20},
+		{"id": 2, "address": "192.0.2.1:53", "type": "TCP", "tcpAcceptErrors": 3, "tlsHandshakeFailuresVersion": 4},
+		{"id": 3, "address": "192.0.2.1:53", "type": "TCP", "tcpAcceptErrors": 5},
+		{"id": 4, "address": "192.0.2.1:53", "type": "UDP", "paused": true}
+	]}`)
+	m := frontendMetrics(api.Frontends)
+	want := map[string]float64{
+		"frontend.udp-__1_53.accept-errors":       1,
+		"frontend.udp-__1_53.outstanding":         2,
+		"frontend.udp-1___53.accept-errors":       10,
+		"frontend.udp-1___53.outstanding":         20,
+		"frontend.tcp-192_0_2_1_53.accept-errors": 12,
+		"frontends-active":                        4,
+		"frontends-paused":                        1,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+}
+
+func TestAddressKey(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"192.0.2.1:53", "192_0_2_1_53"},
+		{"192.0.2.1", "192_0_2_1"},
+		{"[2001:db8::1]:53", "2001_db8__1_53"},
+		{"[2001:db8:1::]:53", "2001_db8_1___53"},
+		{"[2001:0db8:0000::0001]:53", "2001_db8__1_53"},
+		{"[::ffff:192.0.2.1]:53", "192_0_2_1_53"},
+		{"[fe80::1%eth0]:53", "fe80__1_53"},
+		{"2001:db8::1", "2001_db8__1"},
+		{"ns1.example.com:53", "ns1_example_com_53"},
+		{"backend", "backend"},
+	}
+	for _, tt := range tests {
+		if got := addressKey(tt.address); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestBackendKey(t *testing.T) {
+	if got := backendKey(apiObject{"name": "ns 1", "address": "192.0.2.1:53"}); got != "ns_1" {
+		t.Errorf("named backend: got %s", got)
+	}
+	if got := backendKey(apiObject{"name": "", "address": "[2001:db8::1]:53"}); got != "2001_db8__1_53" {
+		t.Errorf("unnamed backend: got %s", got)
+	}
+}
+
+func TestRuleConfig(t *testing.T) {
+	api := parseServersAPI(t, `{"rules": [
+		{"id": 0, "uuid": "a", "rule": "qname==example.com.", "action": "drop", "matches": 1},
+		{"id": 1, "uuid": "b", "rule": "qname==example.net.", "action": "drop", "matches": 2},
+		{"id": 2, "uuid": "c", "rule": "qtype==ANY", "action": "spoof in 192.0.2.1", "matches": 3},
+		{"id": 3, "uuid": "d", "rule": "all", "action": "delay by 100 ms", "matches": 4},
+		{"id": 4, "uuid": "e", "rule": "all", "action": "", "matches": 5}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", RuleMetrics: true, WorkDir: t.TempDir()}
+	m := p.serversAPIMetrics(api)
+	want := map[string]float64{
+		"rule-config.drop":  2,
+		"rule-config.spoof": 1,
+		"rule-config.delay": 1,
+		"rule-config.none":  1,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+	n := 0
+	for k := range m {
+		if strings.HasPrefix(k, "rule-config.") {
+			n++
+		}
+	}
+	if n != len(want) {
+		t.Errorf("unexpected rule-config metrics in %v", m)
+	}
+}
+
+func TestRuleActionKey(t *testing.T) {
+	for action, want := range map[string]string{
+		"drop":               "drop",
+		"Spoof in 192.0.2.1": "spoof",
+		"delay by 100 ms":    "delay",
+		"":                   "none",
+		"!!":                 "none",
+	} {
+		if got := ruleActionKey(action); got != want {
+			t.Errorf("%q: got %s, want %s", action, got, want)
+		}
+	}
+}
+
+func TestFrontendProtocol(t *testing.T) {
+	for typ, want := range map[string]string{
+		"UDP":                  "udp",
+		"TCP":                  "tcp",
+		"TCP (DNS over TLS)":   "dot",
+		"TCP (DNS over HTTPS)": "doh",
+		"UDP (DNS over QUIC)":  "doq",
+		"DoT":                  "dot",
+		"DoH":                  "doh",
+		"DNSCrypt (UDP)":       "dnscrypt",
+	} {
+		if got := frontendProtocol(apiObject{"type": typ}); got != want {
+			t.Errorf("%q: got %s, want %s", typ, got, want)
+		}
+	}
+	if got := frontendProtocol(apiObject{"tcp": true}); got != "tcp" {
+		t.Errorf("without type: got %s, want tcp", got)
+	}
+}
+
+func TestProtocolMetrics(t *testing.T) {
+	api := parseServersAPI(t, `{"frontends": [
+		{"id": 0, "address": "192.0.2.1:53", "type": "UDP", "queries": 100, "responses": 90},
+		{"id": 1, "address": "[2001:db8::1]:53", "type": "UDP", "queries": 50, "responses": 45},
+		{"id": 2, "address": "192.0.2.1:53", "type": "TCP", "queries": 10, "responses": 10},
+		{"id": 3, "address": "[2001:db8::1]:53", "type": "TCP", "queries": 5, "responses": 5},
+		{"id": 4, "address": "192.0.2.1:853", "type": "TCP (DNS over TLS)", "queries": 20, "responses": 19},
+		{"id": 5, "address": "[2001:db8::1]:853", "type": "TCP (DNS over TLS)", "queries": 2, "responses": 2},
+		{"id": 6, "address": "192.0.2.1:443", "type": "TCP (DNS over HTTPS)", "queries": 30, "responses": 28},
+		{"id": 7, "address": "[2001:db8::1]:443", "type": "TCP (DNS over HTTPS)", "queries": 3, "responses": 3},
+		{"id": 8, "address": "192.0.2.1:853", "type": "UDP (DNS over QUIC)", "queries": 7, "responses": 6},
+		{"id": 9, "address": "[2001:db8::1]:853", "type": "UDP (DNS over QUIC)", "queries": 1, "responses": 1}
+	]}`)
+	m := frontendMetrics(api.Frontends)
+	want := map[string]float64{
+		"protocol-queries.udp":   150,
+		"protocol-queries.tcp":   15,
+		"protocol-queries.dot":   22,
+		"protocol-queries.doh":   33,
+		"protocol-queries.doq":   8,
+		"protocol-responses.udp": 135,
+		"protocol-responses.tcp": 15,
+		"protocol-responses.dot": 21,
+		"protocol-responses.doh": 31,
+		"protocol-responses.doq": 7,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+	for k := range m {
+		if strings.HasPrefix(k, "protocol-") {
+			if _, ok := want[k]; !ok {
+				t.Errorf("unexpected %s", k)
+			}
+		}
+	}
+}
+
+func TestLoadVsWeight(t *testing.T) {
+	api := parseServersAPI(t, `{"servers": [
+		{"name": "b1", "address": "192.0.2.1:53", "outstanding": 6, "weight": 3},
+		{"name": "b2", "address": "192.0.2.2:53", "outstanding": 0, "weight": 1},
+		{"name": "b3", "address": "192.0.2.3:53", "outstanding": 5, "weight": 0},
+		{"name": "b4", "address": "192.0.2.4:53", "outstanding": 5}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir()}
+	m := p.backendMetrics(api.Servers)
+	if m["backend.b1.load-vs-weight"] != 2 {
+		t.Errorf("b1: got %v, want 2", m["backend.b1.load-vs-weight"])
+	}
+	if v, ok := m["backend.b2.load-vs-weight"]; !ok || v != 0 {
+		t.Errorf("b2: got %v, want 0", v)
+	}
+	// no share is intended without a weight
+	for _, k := range []string{"backend.b3.load-vs-weight", "backend.b4.load-vs-weight"} {
+		if _, ok := m[k]; ok {
+			t.Errorf("%s is emitted", k)
+		}
+	}
+}
+
+const testFilterServersAPI = `{
+	"servers": [
+		{"name": "b1", "address": "192.0.2.1:53", "state": "up", "queries": 1, "pools": ["", "abuse"]},
+		{"name": "b2", "address": "192.0.2.2:53", "state": "up", "queries": 2, "pools": ["abuse"]},
+		{"name": "b3", "address": "192.0.2.3:53", "state": "up", "queries": 3, "pools": []}
+	],
+	"pools": [
+		{"id": 0, "name": "", "cacheHits": 1},
+		{"id": 1, "name": "abuse", "cacheHits": 2}
+	]
+}`
+
+// entityKeys returns the entities of per-entity metrics, such as backend.b1
+func entityKeys(m map[string]float64) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for k := range m {
+		parts := strings.SplitN(k, ".", 3)
+		if len(parts) < 3 || !isEntityKey(k) || seen[parts[0]+"."+parts[1]] {
+			continue
+		}
+		seen[parts[0]+"."+parts[1]] = true
+		keys = append(keys, parts[0]+"."+parts[1])
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestOnlyBackend(t *testing.T) {
+	api := parseServersAPI(t, testFilterServersAPI)
+	for _, only := range []string{"b2", "192.0.2.2:53"} {
+		p := &Plugin{Prefix: "dnsdist", BackendMetrics: true, PoolMetrics: true, OnlyBackends: []string{only}, WorkDir: t.TempDir()}
+		m := p.serversAPIMetrics(api)
+		// pools are not filtered by --only-backend
+		want := "backend.b2 pool.abuse pool.default"
+		if got := strings.Join(entityKeys(m), " "); got != want {
+			t.Errorf("--only-backend %s: got %s, want %s", only, got, want)
+		}
+	}
+}
+
+func TestOnlyPool(t *testing.T) {
+	api := parseServersAPI(t, testFilterServersAPI)
+	p := &Plugin{Prefix: "dnsdist", BackendMetrics: true, PoolMetrics: true, OnlyPools: []string{"abuse"}, WorkDir: t.TempDir()}
+	m := p.serversAPIMetrics(api)
+	want := "backend.b1 backend.b2 pool.abuse"
+	if got := strings.Join(entityKeys(m), " "); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// the default pool is the unnamed one
+	p = &Plugin{Prefix: "dnsdist", BackendMetrics: true, PoolMetrics: true, OnlyPools: []string{""}, WorkDir: t.TempDir()}
+	m = p.serversAPIMetrics(api)
+	want = "backend.b1 pool.default"
+	if got := strings.Join(entityKeys(m), " "); got != want {
+		t.Errorf("default pool: got %s, want %s", got, want)
+	}
+}
+
+func TestDiscovered(t *testing.T) {
+	api := parseServersAPI(t, `{
+		"servers": [{"name": "b1", "address": "192.0.2.1:53"}, {"name": "b2", "address": "192.0.2.2:53"}, {"name": "b3", "address": "192.0.2.3:53"}],
+		"frontends": [{"id": 0, "address": "192.0.2.1:53", "type": "UDP"}, {"id": 1, "address": "192.0.2.1:53", "type": "TCP"}],
+		"pools": [{"id": 0, "name": ""}]
+	}`)
+	// counted regardless of the filters
+	p := &Plugin{Prefix: "dnsdist", BackendMetrics: true, OnlyBackends: []string{"b1"}, WorkDir: t.TempDir()}
+	m := p.serversAPIMetrics(api)
+	want := map[string]float64{
+		"discovered.backends":  3,
+		"discovered.frontends": 2,
+		"discovered.pools":     1,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+	if _, ok := p.GraphDefinition()["discovered"]; !ok {
+		t.Error("graph discovered is not defined")
+	}
+}
+
+func TestQueriesPerConnection(t *testing.T) {
+	api := parseServersAPI(t, `{"servers": [
+		{"name": "b1", "address": "192.0.2.1:53", "tcpQueries": 30, "tcpNewConnections": 4, "tcpAvgQueriesPerConnection": 1},
+		{"name": "b2", "address": "192.0.2.2:53", "tcpQueries": 0, "tcpNewConnections": 0},
+		{"name": "b3", "address": "192.0.2.3:53", "tcpAvgQueriesPerConnection": 2.5},
+		{"name": "b4", "address": "192.0.2.4:53", "tcpQueries": 30}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir()}
+	m := p.backendMetrics(api.Servers)
+	want := map[string]float64{
+		"backend.b1.queries-per-connection": 7.5,
+		// no connections yet
+		"backend.b2.queries-per-connection": 0,
+		// the average of versions without the counters
+		"backend.b3.queries-per-connection": 2.5,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+	if _, ok := m["backend.b4.queries-per-connection"]; ok {
+		t.Error("backend.b4.queries-per-connection is emitted without connections")
+	}
+}
+
+func TestWeightedQPS(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir()}
+	first := parseServersAPI(t, `{"servers": [
+		{"name": "b1", "address": "192.0.2.1:53", "queries": 100, "weight": 2},
+		{"name": "b2", "address": "192.0.2.2:53", "queries": 100, "weight": 0}
+	]}`)
+	m := p.backendMetrics(first.Servers)
+	for k := range m {
+		if strings.HasSuffix(k, ".weighted-qps") {
+			t.Errorf("%s is emitted on the first run", k)
+		}
+	}
+
+	// the previous run was 10 seconds ago
+	snapshot := counterSnapshot{Time: time.Now().Add(-10 * time.Second), Values: map[string]float64{"backend.b1": 100, "backend.b2": 100}}
+	if err := p.saveState(p.stateFile("backend-queries"), snapshot); err != nil {
+		t.Fatal(err)
+	}
+	second := parseServersAPI(t, `{"servers": [
+		{"name": "b1", "address": "192.0.2.1:53", "queries": 300, "weight": 2},
+		{"name": "b2", "address": "192.0.2.2:53", "queries": 300, "weight": 0}
+	]}`)
+	m = p.backendMetrics(second.Servers)
+	// 200 queries in 10 seconds per weight 2
+	if got := m["backend.b1.weighted-qps"]; math.Abs(got-10) > 0.1 {
+		t.Errorf("backend.b1.weighted-qps: got %v, want 10", got)
+	}
+	if _, ok := m["backend.b2.weighted-qps"]; ok {
+		t.Error("backend.b2.weighted-qps is emitted without a weight")
+	}
+}
+
+func TestRuleChainLength(t *testing.T) {
+	api := parseServersAPI(t, `{
+		"rules": [{"id": 0, "action": "drop"}, {"id": 1, "action": "drop"}, {"id": 2, "action": "spoof in 192.0.2.1"}],
+		"response-rules": [{"id": 0, "action": "drop"}]
+	}`)
+	p := &Plugin{Prefix: "dnsdist", RuleMetrics: true, WorkDir: t.TempDir()}
+	m := p.serversAPIMetrics(api)
+	if m["rule-chain-length"] != 3 || m["response-rule-chain-length"] != 1 {
+		t.Errorf("rule-chain-length %v, response-rule-chain-length %v", m["rule-chain-length"], m["response-rule-chain-length"])
+	}
+
+	// 0 without rules
+	m = p.serversAPIMetrics(parseServersAPI(t, `{"servers": []}`))
+	for _, k := range []string{"rule-chain-length", "response-rule-chain-length"} {
+		if v, ok := m[k]; !ok || v != 0 {
+			t.Errorf("%s without rules: got %v", k, v)
+		}
+	}
+}
+
+func TestPoolMetrics(t *testing.T) {
+	api := parseServersAPI(t, `{"pools": [
+		{"id": 0, "name": "", "serversCount": 2, "cacheSize": 100, "cacheEntries": 10, "cacheHits": 40, "cacheMisses": 60},
+		{"id": 1, "name": "abuse", "serversCount": 1, "cacheSize": 1000, "cacheEntries": 500, "cacheHits": 7, "cacheMisses": 3},
+		{"id": 2, "name": "nocache", "serversCount": 1}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir()}
+	m := p.poolMetrics(api.Pools)
+	want := map[string]float64{
+		"pool.default.cache-hits":    40,
+		"pool.default.cache-misses":  60,
+		"pool.default.cache-entries": 10,
+		"pool.abuse.cache-hits":      7,
+		"pool.abuse.cache-misses":    3,
+		"pool.abuse.cache-entries":   500,
+	}
+	if len(m) != len(want) {
+		t.Errorf("got %v", m)
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+}
+
+func TestPoolCacheMemory(t *testing.T) {
+	api := parseServersAPI(t, `{"pools": [
+		{"id": 0, "name": "", "cacheEntries": 10, "cacheMemory": 4096},
+		{"id": 1, "name": "old", "cacheEntries": 10}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", PoolMetrics: true, WorkDir: t.TempDir()}
+	m := p.poolMetrics(api.Pools)
+	if m["pool.default.cache-memory"] != 4096 {
+		t.Errorf("pool.default.cache-memory: got %v, want 4096", m["pool.default.cache-memory"])
+	}
+	// versions without the field
+	if _, ok := m["pool.old.cache-memory"]; ok {
+		t.Error("pool.old.cache-memory is emitted without cacheMemory")
+	}
+	found := false
+	for _, metric := range p.graphDefinition()["pool.#"].Metrics {
+		found = found || metric.Name == "cache-memory"
+	}
+	if !found {
+		t.Error("cache-memory is not in pool.#")
+	}
+}
+
+func TestBackendLatencyBuckets(t *testing.T) {
+	api := parseServersAPI(t, `{"servers": [
+		{"name": "b1", "address": "192.0.2.1:53", "latency": 1.5, "latencyTCP": 3,
+		 "latency0-1": 10, "latency1-10": 20, "latency10-50": 5, "latency50-100": 2, "latency100-1000": 1, "latency-slow": 3}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", BackendLatencyBuckets: true, WorkDir: t.TempDir()}
+	m := p.backendMetrics(api.Servers)
+	want := map[string]float64{
+		"backend.b1.latency-bucket.0-1":      10,
+		"backend.b1.latency-bucket.1-10":     20,
+		"backend.b1.latency-bucket.10-50":    5,
+		"backend.b1.latency-bucket.50-100":   2,
+		"backend.b1.latency-bucket.100-1000": 1,
+		"backend.b1.latency-bucket.slow":     3,
+	}
+	n := 0
+	for k := range m {
+		if strings.Contains(k, ".latency-bucket.") {
+			n++
+		}
+	}
+	if n != len(want) {
+		t.Errorf("got %v", m)
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+
+	// gated by --backend-latency-buckets
+	p = &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir()}
+	for k := range p.backendMetrics(api.Servers) {
+		if strings.Contains(k, ".latency-bucket.") {
+			t.Errorf("%s is emitted without --backend-latency-buckets", k)
+		}
+	}
+}
+
+func TestResponseRuleAction(t *testing.T) {
+	api := parseServersAPI(t, `{"response-rules": [
+		{"id": 0, "rule": "rcode==5", "action": "drop", "matches": 3},
+		{"id": 1, "rule": "rcode==2", "action": "drop", "matches": 4},
+		{"id": 2, "rule": "all", "action": "delay by 10 ms", "matches": 5},
+		{"id": 3, "rule": "all", "action": "allow"}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", RuleMetrics: true, WorkDir: t.TempDir()}
+	m := p.serversAPIMetrics(api)
+	want := map[string]float64{
+		"response-rule-action.drop":  7,
+		"response-rule-action.delay": 5,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+	// rules without matches are not counted
+	if _, ok := m["response-rule-action.allow"]; ok {
+		t.Error("response-rule-action.allow is emitted without matches")
+	}
+}
+
+func TestServersAPIFlag(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want bool
+	}{
+		{nil, false},
+		{[]string{"--servers-api"}, true},
+	} {
+		opt, err := parseOpt(t, tt.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opt.impliedFlags()
+		for name, v := range map[string]bool{
+			"rule":     opt.RuleMetrics,
+			"backend":  opt.BackendMetrics,
+			"frontend": opt.FrontendMetrics,
+			"pool":     opt.PoolMetrics,
+		} {
+			if v != tt.want {
+				t.Errorf("%v: %s metrics got %v, want %v", tt.args, name, v, tt.want)
+			}
+		}
+		p := &Plugin{
+			RuleMetrics:     opt.RuleMetrics,
+			BackendMetrics:  opt.BackendMetrics,
+			FrontendMetrics: opt.FrontendMetrics,
+			PoolMetrics:     opt.PoolMetrics,
+		}
+		if p.needServersAPI() != tt.want {
+			t.Errorf("%v: needServersAPI got %v, want %v", tt.args, !tt.want, tt.want)
+		}
+	}
+}
+
+func TestRulesEnabled(t *testing.T) {
+	api := parseServersAPI(t, `{"rules": [
+		{"id": 0, "rule": "all", "action": "drop"},
+		{"id": 1, "rule": "all", "action": "drop", "disabled": true},
+		{"id": 2, "rule": "all", "action": "drop", "enabled": false},
+		{"id": 3, "rule": "all", "action": "drop", "enabled": true},
+		{"id": 4, "rule": "all", "action": "drop", "disabled": false}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", RuleMetrics: true, WorkDir: t.TempDir()}
+	m := p.serversAPIMetrics(api)
+	if m["rules-enabled"] != 3 || m["rules-disabled"] != 2 {
+		t.Errorf("rules-enabled %v, rules-disabled %v, want 3 and 2", m["rules-enabled"], m["rules-disabled"])
+	}
+
+	m = p.serversAPIMetrics(parseServersAPI(t, `{"rules": []}`))
+	if v, ok := m["rules-disabled"]; !ok || v != 0 {
+		t.Errorf("rules-disabled got %v without rules, want 0", v)
+	}
+}
+
+func TestCacheMissRuleMatches(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", RuleMetrics: true, WorkDir: t.TempDir()}
+	m := p.serversAPIMetrics(parseServersAPI(t, `{"cache-miss-rules": [
+		{"id": 0, "rule": "qtype==ANY", "action": "drop", "matches": 4},
+		{"id": 1, "rule": "all", "action": "pool abuse", "matches": 6},
+		{"id": 2, "rule": "all", "action": "allow"}
+	]}`))
+	if m["cache-miss-rule-matches"] != 10 {
+		t.Errorf("cache-miss-rule-matches: got %v, want 10", m["cache-miss-rule-matches"])
+	}
+
+	// versions without cache-miss rules
+	m = p.serversAPIMetrics(parseServersAPI(t, `{"rules": []}`))
+	if _, ok := m["cache-miss-rule-matches"]; ok {
+		t.Error("cache-miss-rule-matches is emitted without cache-miss-rules")
+	}
+}
+
+func TestTransportShare(t *testing.T) {
+	frontends := func(udp, dot, doh, doq int) string {
+		return fmt.Sprintf(`{"frontends": [
+			{"id": 0, "address": "192.0.2.1:53", "type": "UDP", "queries": %d},
+			{"id": 1, "address": "192.0.2.1:853", "type": "TCP (DNS over TLS)", "queries": %d},
+			{"id": 2, "address": "192.0.2.1:443", "type": "TCP (DNS over HTTPS)", "queries": %d},
+			{"id": 3, "address": "192.0.2.1:853", "type": "UDP (DNS over QUIC)", "queries": %d}
+		]}`, udp, dot, doh, doq)
+	}
+	p := &Plugin{Prefix: "dnsdist", FrontendMetrics: true, WorkDir: t.TempDir()}
+	m := p.serversAPIMetrics(parseServersAPI(t, frontends(100, 10, 10, 10)))
+	for k := range m {
+		if strings.HasPrefix(k, "transport-share.") {
+			t.Errorf("%s is emitted on the first run", k)
+		}
+	}
+
+	m = p.serversAPIMetrics(parseServersAPI(t, frontends(150, 30, 20, 30)))
+	want := map[string]float64{
+		"transport-share.udp": 50,
+		"transport-share.dot": 20,
+		"transport-share.doh": 10,
+		"transport-share.doq": 20,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+
+	// no queries during the interval
+	m = p.serversAPIMetrics(parseServersAPI(t, frontends(150, 30, 20, 30)))
+	for k := range want {
+		if got, ok := m[k]; !ok || got != 0 {
+			t.Errorf("%s: got %v without queries, want 0", k, got)
+		}
+	}
+}
+
+func TestLuaKind(t *testing.T) {
+	for description, want := range map[string]string{
+		"Lua script":                   "lua",
+		"Lua FFI script":               "ffi",
+		"Lua FFI per-thread script":    "ffi",
+		"lua ffi script":               "ffi",
+		"drop":                         "",
+		"qname matches Lua-like regex": "",
+		"":                             "",
+	} {
+		if got := luaKind(description); got != want {
+			t.Errorf("%q: got %q, want %q", description, got, want)
+		}
+	}
+}
+
+func TestLuaRules(t *testing.T) {
+	api := parseServersAPI(t, `{"rules": [
+		{"id": 0, "rule": "Lua script", "action": "drop"},
+		{"id": 1, "rule": "all", "action": "Lua script"},
+		{"id": 2, "rule": "Lua FFI script", "action": "drop"},
+		{"id": 3, "rule": "all", "action": "Lua FFI per-thread script"},
+		{"id": 4, "rule": "Lua script", "action": "Lua FFI script"},
+		{"id": 5, "rule": "all", "action": "drop"}
+	]}`)
+	p := &Plugin{Prefix: "dnsdist", RuleMetrics: true, WorkDir: t.TempDir()}
+	m := p.serversAPIMetrics(api)
+	// rule 4 is counted once as FFI
+	if m["lua-rules-lua"] != 2 || m["lua-rules-ffi"] != 3 {
+		t.Errorf("lua-rules-lua %v, lua-rules-ffi %v, want 2 and 3", m["lua-rules-lua"], m["lua-rules-ffi"])
+	}
+}
+
+func TestMinQueriesForBackend(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", WorkDir: t.TempDir(), MinQueriesForBackend: 10}
+	first := parseServersAPI(t, `{"servers": [
+		{"name": "busy", "address": "192.0.2.1:53", "queries": 100},
+		{"name": "idle", "address": "192.0.2.2:53", "queries": 100}
+	]}`)
+	m := p.backendMetrics(first.Servers)
+	// nothing to compare with on the first run
+	for _, k := range []string{"backend.busy.flaps", "backend.idle.flaps"} {
+		if _, ok := m[k]; !ok {
+			t.Errorf("%s is omitted on the first run", k)
+		}
+	}
+
+	second := parseServersAPI(t, `{"servers": [
+		{"name": "busy", "address": "192.0.2.1:53", "queries": 150},
+		{"name": "idle", "address": "192.0.2.2:53", "queries": 103},
+		{"name": "new", "address": "192.0.2.3:53", "queries": 1}
+	]}`)
+	m = p.backendMetrics(second.Servers)
+	for k := range m {
+		if strings.HasPrefix(k, "backend.idle.") {
+			t.Errorf("%s is emitted for a backend with 3 queries", k)
+		}
+	}
+	// backends without a delta are kept
+	for _, k := range []string{"backend.busy.flaps", "backend.new.flaps"} {
+		if _, ok := m[k]; !ok {
+			t.Errorf("%s is omitted", k)
+		}
+	}
+}
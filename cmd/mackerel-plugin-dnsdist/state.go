@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mackerelio/golib/pluginutil"
+)
+
+// workDir returns the directory of state files. MACKEREL_PLUGIN_WORKDIR is
+// honored when --work-dir is not specified.
+func (p *Plugin) workDir() string {
+	if p.WorkDir != "" {
+		return p.WorkDir
+	}
+	return pluginutil.PluginWorkDir()
+}
+
+// stateFile returns the path of a state file for the given name. the path is
+// unique per metric key prefix, dnsdist URL and arguments, as the tempfile of
+// go-mackerel-plugin, so that instances with different options do not share
+// state. the scheme is ignored since it may change with --scheme auto.
+func (p *Plugin) stateFile(name string) string {
+	u := p.URL
+	if i := strings.Index(u, "://"); i >= 0 {
+		u = u[i+3:]
+	}
+	key := strings.Join(append([]string{u}, p.Args...), " ")
+	return filepath.Join(
+		p.workDir(),
+		fmt.Sprintf("mackerel-plugin-%s-%s-%x", p.MetricKeyPrefix(), name, sha1.Sum([]byte(key))),
+	)
+}
+
+// loadState reads a JSON state file into v. a missing file is not an error.
+// gzipped files are read regardless of --compress-state, so that the option
+// can be toggled.
+func (p *Plugin) loadState(path string, v interface{}) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if bytes.HasPrefix(buf, gzipMagic) {
+		r, err := gzip.NewReader(bytes.NewReader(buf))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return json.NewDecoder(r).Decode(v)
+	}
+	return json.Unmarshal(buf, v)
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+func (p *Plugin) saveState(path string, v interface{}) error {
+	return p.saveStateMode(path, v, 0644)
+}
+
+// saveStateMode saves a state file with the permission perm, for states
+// containing secrets
+func (p *Plugin) saveStateMode(path string, v interface{}, perm os.FileMode) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if p.CompressState {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		buf = b.Bytes()
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// a new file with a random name, not to follow a file planted in a
+	// shared work dir
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkDir(t *testing.T) {
+	dir := t.TempDir()
+	p := &Plugin{Prefix: "dnsdist", URL: "http://127.0.0.1:8083/jsonstat?command=stats", WorkDir: dir}
+	path := p.stateFile("test")
+	if filepath.Dir(path) != dir {
+		t.Fatalf("state file %s is not in --work-dir %s", path, dir)
+	}
+
+	if err := p.saveState(path, map[string]float64{"queries": 1}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || filepath.Join(dir, entries[0].Name()) != path {
+		t.Errorf("unexpected files in --work-dir: %v", entries)
+	}
+
+	got := map[string]float64{}
+	if err := p.loadState(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["queries"] != 1 {
+		t.Errorf("queries: got %v", got["queries"])
+	}
+
+	// a missing state is not an error
+	if err := p.loadState(p.stateFile("missing"), &got); err != nil {
+		t.Errorf("missing state: %v", err)
+	}
+}
+
+func TestWorkDirEnv(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("MACKEREL_PLUGIN_WORKDIR", dir)
+	p := &Plugin{Prefix: "dnsdist"}
+	if got := p.workDir(); got != dir {
+		t.Errorf("got %s, want MACKEREL_PLUGIN_WORKDIR %s", got, dir)
+	}
+	p.WorkDir = filepath.Join(dir, "sub")
+	if got := p.workDir(); got != p.WorkDir {
+		t.Errorf("got %s, want --work-dir %s", got, p.WorkDir)
+	}
+}
+
+func TestCompressState(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", URL: "http://127.0.0.1:8083/jsonstat?command=stats", WorkDir: t.TempDir(), CompressState: true}
+	path := p.stateFile("test")
+	state := circuitState{Failures: 2}
+	if err := p.saveState(path, state); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf, gzipMagic) {
+		t.Errorf("state is not gzipped: %q", buf)
+	}
+
+	got := circuitState{}
+	if err := p.loadState(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Failures != 2 {
+		t.Errorf("failures: got %d", got.Failures)
+	}
+
+	// readable after toggling the option
+	p.CompressState = false
+	got = circuitState{}
+	if err := p.loadState(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Failures != 2 {
+		t.Errorf("failures without --compress-state: got %d", got.Failures)
+	}
+	if err := p.saveState(path, state); err != nil {
+		t.Fatal(err)
+	}
+	p.CompressState = true
+	got = circuitState{}
+	if err := p.loadState(path, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Failures != 2 {
+		t.Errorf("failures of a plain state: got %d", got.Failures)
+	}
+}
+
+func TestSaveStateSymlink(t *testing.T) {
+	dir := t.TempDir()
+	p := &Plugin{Prefix: "dnsdist", URL: "http://127.0.0.1:8083/jsonstat?command=stats", WorkDir: dir}
+	path := p.stateFile("apikey")
+	target := filepath.Join(t.TempDir(), "target")
+	if err := os.WriteFile(target, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, path+".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.saveStateMode(path, apiKeyState{APIKey: "secret"}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "original" {
+		t.Errorf("a planted symlink is followed: %q", buf)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm() != 0600 {
+		t.Errorf("unexpected state file mode: %v", fi.Mode())
+	}
+}
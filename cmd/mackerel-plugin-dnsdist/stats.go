@@ -0,0 +1,197 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// statsMetrics returns metrics derived from the fields of jsonstat
+func statsMetrics(stats map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for k, v := range dohStatusMetrics(stats) {
+		result[k] = v
+	}
+	for k, v := range selfAnsweredRcodeMetrics(stats) {
+		result[k] = v
+	}
+	for k, v := range pipeFullMetrics(stats) {
+		result[k] = v
+	}
+	for k, v := range ednsOptionMetrics(stats) {
+		result[k] = v
+	}
+	for k, v := range doqMetrics(stats) {
+		result[k] = v
+	}
+	for k, v := range opcodeMetrics(stats) {
+		result[k] = v
+	}
+	for k, v := range cacheEntriesByTypeMetrics(stats) {
+		result[k] = v
+	}
+	for k, v := range responseRcodeMetrics(stats) {
+		result[k] = v
+	}
+	return result
+}
+
+// matches doh-http1-200-responses, doh-2xx-responses, etc.
+var dohStatusRegexp = regexp.MustCompile(`^doh-(?:.+-)?([1-5])(?:\d\d|xx)-responses$`)
+
+func dohStatusMetrics(stats map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for k, v := range stats {
+		m := dohStatusRegexp.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		result["doh-status."+m[1]+"xx"] += v
+	}
+	return result
+}
+
+// matches self-answered-nxdomain, self-answered-refused, etc.
+var selfAnsweredRcodeRegexp = regexp.MustCompile(`^self-answered-([a-z]+)$`)
+
+func selfAnsweredRcodeMetrics(stats map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for k, v := range stats {
+		m := selfAnsweredRcodeRegexp.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		result["self-answered-rcode."+m[1]] = v
+	}
+	return result
+}
+
+// pipeFullMetrics groups tcp-query-pipe-full, doh-query-pipe-full, etc.
+func pipeFullMetrics(stats map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for k, v := range stats {
+		if strings.HasSuffix(k, "-pipe-full") {
+			result["pipe-full."+k] = v
+		}
+	}
+	return result
+}
+
+// ednsOptionMetrics groups counters of queries with EDNS options such as
+// edns-cookie or edns-ecs
+func ednsOptionMetrics(stats map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for k, v := range stats {
+		if !strings.HasPrefix(k, "edns-") || strings.HasPrefix(k, "edns-version-") {
+			continue
+		}
+		if option := strings.TrimPrefix(k, "edns-"); option != "" {
+			result["edns-options."+option] = v
+		}
+	}
+	return result
+}
+
+// doqMetrics groups doq-* counters of DoQ frontends. instances without DoQ
+// have none of them.
+func doqMetrics(stats map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for k, v := range stats {
+		if strings.HasPrefix(k, "doq-") {
+			result["doq."+k] = v
+		}
+	}
+	return result
+}
+
+// opcodeMetrics groups queries by opcode (opcode-query, opcode-notify, ...)
+// and by EDNS version (edns-version-0, ...)
+func opcodeMetrics(stats map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for k, v := range stats {
+		switch {
+		case strings.HasPrefix(k, "opcode-"):
+			result["opcode."+strings.TrimPrefix(k, "opcode-")] = v
+		case strings.HasPrefix(k, "edns-version-"):
+			result["edns-version."+strings.TrimPrefix(k, "edns-version-")] = v
+		}
+	}
+	return result
+}
+
+// matches cache-entries-a, cache-entries-aaaa, etc. reported by builds
+// exposing the packet cache composition per qtype
+var cacheEntriesByTypeRegexp = regexp.MustCompile(`^cache-entries-([a-z0-9]+)$`)
+
+func cacheEntriesByTypeMetrics(stats map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for k, v := range stats {
+		m := cacheEntriesByTypeRegexp.FindStringSubmatch(k)
+		if m == nil {
+			continue
+		}
+		result["cache-entries-by-type."+m[1]] = v
+	}
+	return result
+}
+
+// responseRcodeMetrics groups responses sent to clients by rcode.
+// servfail-responses is not used for versions without frontend-* as it
+// counts responses from backends, not to clients.
+func responseRcodeMetrics(stats map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for _, rcode := range backendRcodes {
+		if v, ok := stats["frontend-"+rcode]; ok {
+			result["response-rcode."+rcode] = v
+		}
+	}
+	return result
+}
+
+// ruleRateOutcomes are the rule outcomes reported as a share of queries
+var ruleRateOutcomes = []string{"drop", "nxdomain", "refused"}
+
+// ruleRateMetrics returns the share (%) of queries per rule outcome during
+// the last interval
+func (p *Plugin) ruleRateMetrics(stats map[string]float64) map[string]float64 {
+	cur := map[string]float64{"queries": stats["queries"]}
+	for _, o := range ruleRateOutcomes {
+		cur["rule-"+o] = stats["rule-"+o]
+	}
+	deltas, _, ok := p.deltaSinceLastRun("rule-rate", cur)
+	if !ok {
+		return nil
+	}
+	queries, ok := deltas["queries"]
+	if !ok {
+		return nil
+	}
+	result := map[string]float64{}
+	for _, o := range ruleRateOutcomes {
+		if d, ok := deltas["rule-"+o]; ok {
+			result["rule-rate-"+o] = percentage(d, queries)
+		}
+	}
+	return result
+}
+
+// answerSourceMetrics returns the share (%) of answers by dnsdist itself and
+// by backends during the last interval
+func (p *Plugin) answerSourceMetrics(stats map[string]float64) map[string]float64 {
+	cur := map[string]float64{
+		"self-answered": stats["self-answered"],
+		"responses":     stats["responses"],
+	}
+	deltas, _, ok := p.deltaSinceLastRun("answer-source", cur)
+	if !ok {
+		return nil
+	}
+	self, sok := deltas["self-answered"]
+	backend, bok := deltas["responses"]
+	if !sok || !bok {
+		return nil
+	}
+	return map[string]float64{
+		"answer-source-self":    percentage(self, self+backend),
+		"answer-source-backend": percentage(backend, self+backend),
+	}
+}
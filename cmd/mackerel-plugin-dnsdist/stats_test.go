@@ -0,0 +1,349 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRuleRateMetrics(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", RuleRate: true, WorkDir: t.TempDir()}
+	if m := p.ruleRateMetrics(map[string]float64{"queries": 100, "rule-drop": 10}); m != nil {
+		t.Errorf("rates on the first run: %v", m)
+	}
+	m := p.ruleRateMetrics(map[string]float64{"queries": 300, "rule-drop": 30, "rule-refused": 50})
+	want := map[string]float64{"rule-rate-drop": 10, "rule-rate-nxdomain": 0, "rule-rate-refused": 25}
+	for k, v := range want {
+		if m[k] != v {
+			t.Errorf("%s: got %v, want %v", k, m[k], v)
+		}
+	}
+	// no queries during the interval
+	m = p.ruleRateMetrics(map[string]float64{"queries": 300, "rule-drop": 30, "rule-refused": 50})
+	if m["rule-rate-drop"] != 0 {
+		t.Errorf("rule-rate-drop without queries: got %v", m["rule-rate-drop"])
+	}
+}
+
+func TestRuleRateDisabled(t *testing.T) {
+	ts, _ := newTestServer(t, testStats)
+	p := newTestPlugin(t, ts.URL)
+	for i := 0; i < 2; i++ {
+		m, err := p.fetchMetrics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m["rule-rate-drop"]; ok {
+			t.Fatal("rule-rate-drop is emitted without --rule-rate")
+		}
+	}
+	if _, err := os.Stat(p.stateFile("rule-rate")); !os.IsNotExist(err) {
+		t.Errorf("rule-rate state is written without --rule-rate: %v", err)
+	}
+	if _, ok := p.GraphDefinition()["rule-rate"]; ok {
+		t.Error("rule-rate graph is defined without --rule-rate")
+	}
+}
+
+func TestAnswerSourceMetrics(t *testing.T) {
+	p := &Plugin{Prefix: "dnsdist", AnswerSource: true, WorkDir: t.TempDir()}
+	if m := p.answerSourceMetrics(map[string]float64{"self-answered": 10, "responses": 10}); m != nil {
+		t.Errorf("split on the first run: %v", m)
+	}
+	m := p.answerSourceMetrics(map[string]float64{"self-answered": 35, "responses": 85})
+	if m["answer-source-self"] != 25 || m["answer-source-backend"] != 75 {
+		t.Errorf("unexpected split: %v", m)
+	}
+	// no answers during the interval
+	m = p.answerSourceMetrics(map[string]float64{"self-answered": 35, "responses": 85})
+	if m["answer-source-self"] != 0 || m["answer-source-backend"] != 0 {
+		t.Errorf("split without answers: %v", m)
+	}
+}
+
+func TestAnswerSourceDisabled(t *testing.T) {
+	ts, _ := newTestServer(t, testStats)
+	p := newTestPlugin(t, ts.URL)
+	for i := 0; i < 2; i++ {
+		if _, err := p.fetchMetrics(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(p.stateFile("answer-source")); !os.IsNotExist(err) {
+		t.Errorf("answer-source state is written without --answer-source: %v", err)
+	}
+}
+
+func TestNoStateByDefault(t *testing.T) {
+	ts, _ := newTestServer(t, testStats)
+	p := newTestPlugin(t, ts.URL)
+	for i := 0; i < 2; i++ {
+		if _, err := p.FetchMetrics(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(p.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		t.Errorf("state file written by default: %s", e.Name())
+	}
+}
+
+func TestSelfAnsweredRcodeMetrics(t *testing.T) {
+	m := selfAnsweredRcodeMetrics(map[string]float64{
+		"self-answered":          10,
+		"self-answered-nxdomain": 3,
+		"self-answered-refused":  2,
+		"self-answered-servfail": 1,
+		"rule-nxdomain":          4,
+	})
+	want := map[string]float64{
+		"self-answered-rcode.nxdomain": 3,
+		"self-answered-rcode.refused":  2,
+		"self-answered-rcode.servfail": 1,
+	}
+	if len(m) != len(want) {
+		t.Errorf("got %v", m)
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+}
+
+func TestResponseRcodeMetrics(t *testing.T) {
+	m := responseRcodeMetrics(map[string]float64{
+		"frontend-noerror":   90,
+		"frontend-nxdomain":  6,
+		"frontend-servfail":  3,
+		"servfail-responses": 5,
+	})
+	want := map[string]float64{
+		"response-rcode.noerror":  90,
+		"response-rcode.nxdomain": 6,
+		"response-rcode.servfail": 3,
+	}
+	if len(m) != len(want) {
+		t.Errorf("got %v", m)
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+
+	// servfail-responses counts responses from backends
+	m = responseRcodeMetrics(map[string]float64{"servfail-responses": 5})
+	if len(m) != 0 {
+		t.Errorf("got %v without frontend-*", m)
+	}
+}
+
+func TestPipeFullMetrics(t *testing.T) {
+	ts, _ := newTestServer(t, `{"queries": 100, "tcp-query-pipe-full": 1, "doh-query-pipe-full": 2, "doh-response-pipe-full": 3, "outgoing-doh-query-pipe-full": 4, "pipe-full-x": 5}`)
+	p := newTestPlugin(t, ts.URL)
+	m, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"pipe-full.tcp-query-pipe-full":          1,
+		"pipe-full.doh-query-pipe-full":          2,
+		"pipe-full.doh-response-pipe-full":       3,
+		"pipe-full.outgoing-doh-query-pipe-full": 4,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+	for k := range m {
+		if _, ok := want[k]; strings.HasPrefix(k, "pipe-full.") && !ok {
+			t.Errorf("unexpected %s", k)
+		}
+	}
+}
+
+func TestEDNSOptionMetrics(t *testing.T) {
+	m := ednsOptionMetrics(map[string]float64{
+		"edns-cookie":    1,
+		"edns-ecs":       2,
+		"edns-version-0": 3,
+		"edns-version-1": 4,
+		"edns-":          5,
+		"queries":        6,
+	})
+	want := map[string]float64{
+		"edns-options.cookie": 1,
+		"edns-options.ecs":    2,
+	}
+	if len(m) != len(want) {
+		t.Errorf("got %v", m)
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+	// edns-version-* belongs to the edns-version graph
+	for k := range m {
+		if strings.HasPrefix(k, "edns-options.version") {
+			t.Errorf("%s is emitted", k)
+		}
+	}
+}
+
+func TestDoQMetrics(t *testing.T) {
+	ts, _ := newTestServer(t, `{"queries": 100, "doq-queries": 10, "doq-responses": 9, "doq-errors": 1}`)
+	p := newTestPlugin(t, ts.URL)
+	m, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"doq.doq-queries":   10,
+		"doq.doq-responses": 9,
+		"doq.doq-errors":    1,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+
+	// instances without DoQ
+	ts, _ = newTestServer(t, testStats)
+	p = newTestPlugin(t, ts.URL)
+	m, err = p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range m {
+		if strings.HasPrefix(k, "doq.") {
+			t.Errorf("%s is emitted without DoQ", k)
+		}
+	}
+}
+
+func TestOpcodeMetrics(t *testing.T) {
+	m := opcodeMetrics(map[string]float64{
+		"opcode-query":   100,
+		"opcode-notify":  2,
+		"opcode-update":  1,
+		"edns-version-0": 80,
+		"edns-version-1": 3,
+		"edns-cookie":    5,
+		"queries":        100,
+	})
+	want := map[string]float64{
+		"opcode.query":   100,
+		"opcode.notify":  2,
+		"opcode.update":  1,
+		"edns-version.0": 80,
+		"edns-version.1": 3,
+	}
+	if len(m) != len(want) {
+		t.Errorf("got %v", m)
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+}
+
+func TestStripKeyPrefix(t *testing.T) {
+	ts, _ := newTestServer(t, `{"dnsdist_queries": 100, "dnsdist_cache-hits": 10, "dnsdist_doh-http1-200-responses": 5, "uptime": 3}`)
+	p := newTestPlugin(t, ts.URL)
+	p.StripKeyPrefix = "dnsdist_"
+	m, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"queries":    100,
+		"cache-hits": 10,
+		"uptime":     3,
+		// derived metrics see the stripped keys
+		"doh-status.2xx": 5,
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+	for k := range m {
+		if strings.HasPrefix(k, "dnsdist_") {
+			t.Errorf("%s is not stripped", k)
+		}
+	}
+}
+
+func TestCacheEntriesByTypeMetrics(t *testing.T) {
+	m := cacheEntriesByTypeMetrics(map[string]float64{
+		"cache-entries":      30,
+		"cache-entries-a":    10,
+		"cache-entries-aaaa": 15,
+		"cache-entries-ns":   5,
+		"cache-hits":         100,
+	})
+	want := map[string]float64{
+		"cache-entries-by-type.a":    10,
+		"cache-entries-by-type.aaaa": 15,
+		"cache-entries-by-type.ns":   5,
+	}
+	if len(m) != len(want) {
+		t.Errorf("got %v", m)
+	}
+	for k, v := range want {
+		if got, ok := m[k]; !ok || got != v {
+			t.Errorf("%s: got %v, want %v", k, got, v)
+		}
+	}
+}
+
+func TestAssertMinMetrics(t *testing.T) {
+	// non-numeric fields are not counted
+	ts, _ := newTestServer(t, `{"queries": 100, "responses": 90, "version": "dnsdist 1.8"}`)
+	p := newTestPlugin(t, ts.URL)
+	p.AssertMinMetrics = 3
+	_, err := p.fetchMetrics()
+	if err == nil {
+		t.Fatal("expected an error for a sparse response")
+	}
+	if !strings.Contains(err.Error(), "only 2 numeric metrics") || !strings.Contains(err.Error(), "at least 3") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	p.AssertMinMetrics = 2
+	if _, err := p.fetchMetrics(); err != nil {
+		t.Errorf("--assert-min-metrics 2: %v", err)
+	}
+}
+
+func TestDropMetricsOnErrorCount(t *testing.T) {
+	ts, _ := newTestServer(t, `{"queries": 100, "a": "x", "b": "y", "c": "z", "d": true, "e": null}`)
+	p := newTestPlugin(t, ts.URL)
+	p.DropMetricsOnErrorCount = 4
+	_, err := p.fetchMetrics()
+	if err == nil {
+		t.Fatal("expected an error for 5 malformed fields")
+	}
+	if !strings.Contains(err.Error(), "5 fields") || !strings.Contains(err.Error(), "a, b, c, d, e") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	for _, n := range []int{5, 0} {
+		p.DropMetricsOnErrorCount = n
+		m, err := p.fetchMetrics()
+		if err != nil {
+			t.Errorf("--drop-metrics-on-error-count %d: %v", n, err)
+		}
+		if m["queries"] != 100 {
+			t.Errorf("--drop-metrics-on-error-count %d: queries got %v", n, m["queries"])
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseThresholds parses key:value pairs of --threshold
+func parseThresholds(specs []string) (map[string]float64, error) {
+	thresholds := map[string]float64{}
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid threshold %q: expected key:value", spec)
+		}
+		v, err := strconv.ParseFloat(spec[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold %q: %w", spec, err)
+		}
+		thresholds[spec[:i]] = v
+	}
+	return thresholds, nil
+}
+
+// thresholdMetricName returns the name of the companion metric of key. dots
+// are replaced so that it is not taken as a part of a graph key.
+func thresholdMetricName(key string) string {
+	return sanitizeMetricKey(key) + "-over"
+}
+
+func (p *Plugin) thresholdKeys() []string {
+	keys := make([]string, 0, len(p.Thresholds))
+	for k := range p.Thresholds {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// thresholdMetrics returns 1 for metrics exceeding their threshold and 0
+// otherwise. values are compared as fetched, before Diff is calculated.
+func (p *Plugin) thresholdMetrics(metrics map[string]float64) map[string]float64 {
+	result := map[string]float64{}
+	for key, threshold := range p.Thresholds {
+		v, ok := metrics[key]
+		if !ok {
+			continue
+		}
+		result[thresholdMetricName(key)] = 0
+		if v > threshold {
+			result[thresholdMetricName(key)] = 1
+		}
+	}
+	return result
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestParseThresholds(t *testing.T) {
+	thresholds, err := parseThresholds([]string{"queries:50", "backend.b1.load-vs-weight:1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thresholds["queries"] != 50 || thresholds["backend.b1.load-vs-weight"] != 1.5 {
+		t.Errorf("got %v", thresholds)
+	}
+	for _, spec := range []string{"queries", ":1", "queries:x"} {
+		if _, err := parseThresholds([]string{spec}); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestThresholdMetrics(t *testing.T) {
+	ts, _ := newTestServer(t, testStats)
+	p := newTestPlugin(t, ts.URL)
+	p.Thresholds = map[string]float64{
+		"queries":            50,
+		"servfail-responses": 1,
+		"missing":            1,
+	}
+	m, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// queries 100 crosses 50. the cumulative counter is compared.
+	if v, ok := m["queries-over"]; !ok || v != 1 {
+		t.Errorf("queries-over: got %v", v)
+	}
+	// equal is not over
+	if v, ok := m["servfail-responses-over"]; !ok || v != 0 {
+		t.Errorf("servfail-responses-over: got %v", v)
+	}
+	if _, ok := m["missing-over"]; ok {
+		t.Error("missing-over is emitted for a missing metric")
+	}
+	g, ok := p.GraphDefinition()["threshold"]
+	if !ok || len(g.Metrics) != 3 {
+		t.Errorf("threshold graph: %+v", g)
+	}
+}
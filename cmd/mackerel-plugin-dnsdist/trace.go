@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// withTrace returns a context logging the time spent in each phase of a
+// request to u: DNS resolution, connect, TLS handshake and the first byte
+func withTrace(ctx context.Context, u string) context.Context {
+	start := time.Now()
+	var dnsStart, tlsStart time.Time
+	// connections to IPv4 and IPv6 addresses can be raced
+	var mu sync.Mutex
+	connectStart := map[string]time.Time{}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			log.Printf("trace %s: dns %s err=%v", u, time.Since(dnsStart), info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart[addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			elapsed := time.Since(connectStart[addr])
+			mu.Unlock()
+			log.Printf("trace %s: connect %s %s err=%v", u, addr, elapsed, err)
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			log.Printf("trace %s: tls handshake %s err=%v", u, time.Since(tlsStart), err)
+		},
+		GotFirstResponseByte: func() {
+			log.Printf("trace %s: first byte %s", u, time.Since(start))
+		},
+	})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTrace(t *testing.T) {
+	ts, _ := newTestServer(t, testStats)
+	p := newTestPlugin(t, ts.URL)
+	p.Trace = true
+	logs := captureLog(t)
+	if _, err := p.fetchMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{"connect ", "first byte "} {
+		if !strings.Contains(logs.String(), "trace "+p.URL+": "+phase) {
+			t.Errorf("%sis not logged: %s", phase, logs)
+		}
+	}
+
+	// nothing is logged without --trace
+	logs = captureLog(t)
+	p = newTestPlugin(t, ts.URL)
+	if _, err := p.fetchMetrics(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "trace ") {
+		t.Errorf("traced without --trace: %s", logs)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// validateConfig returns the problems of the combination of options
+func validateConfig(opt *Opt) []string {
+	var problems []string
+	if opt.GraphSuffix != "" && !graphSuffixRegexp.MatchString(opt.GraphSuffix) {
+		problems = append(problems, fmt.Sprintf("invalid graph suffix: %s", opt.GraphSuffix))
+	}
+	if opt.Flatten && !flattenSeparatorRegexp.MatchString(opt.FlattenSep) {
+		problems = append(problems, fmt.Sprintf("invalid flatten separator: %q", opt.FlattenSep))
+	}
+	if _, err := parseThresholds(opt.Thresholds); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if opt.MetricConfig != "" {
+		if _, err := loadMetricConfig(opt.MetricConfig); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if opt.StatsURL != "" {
+		if _, err := parseStatsURL(opt.StatsURL); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if scheme, _, _ := opt.endpoint(); opt.Insecure && scheme == "http" {
+		problems = append(problems, "--insecure requires --scheme https or auto")
+	}
+	if (opt.SOCKS5User != "" || opt.SOCKS5Password != "") && opt.SOCKS5 == "" {
+		problems = append(problems, "--socks5-user and --socks5-password require --socks5")
+	}
+	if opt.SOCKS5Password != "" && opt.SOCKS5User == "" {
+		problems = append(problems, "--socks5-password requires --socks5-user")
+	}
+	if opt.JSON && opt.OpenMetrics {
+		problems = append(problems, "--json conflicts with --openmetrics")
+	}
+	if (opt.JSON || opt.OpenMetrics) && opt.OutputFormat != "mackerel" {
+		problems = append(problems, "--json and --openmetrics conflict with --output-format")
+	}
+	if opt.HealthEndpointCheck && (opt.Check || opt.ListBackends) {
+		problems = append(problems, "--health-endpoint-check conflicts with --check and --list-backends")
+	}
+	if opt.Check && opt.ListBackends {
+		problems = append(problems, "--check conflicts with --list-backends")
+	}
+	if opt.WarnServfailRate > 0 && opt.CritServfailRate > 0 && opt.WarnServfailRate > opt.CritServfailRate {
+		problems = append(problems, "--warn-servfail-rate is greater than --crit-servfail-rate")
+	}
+	if (opt.WarnServfailRate > 0 || opt.CritServfailRate > 0) && !opt.Check {
+		problems = append(problems, "--warn-servfail-rate and --crit-servfail-rate require --check")
+	}
+	if len(opt.OnlyBackends) > 0 && !opt.BackendMetrics {
+		problems = append(problems, "--only-backend requires --backend-metrics")
+	}
+	if len(opt.OnlyPools) > 0 && !opt.BackendMetrics && !opt.PoolMetrics {
+		problems = append(problems, "--only-pool requires --backend-metrics or --pool-metrics")
+	}
+	if opt.MinQueriesForBackend > 0 && !opt.BackendMetrics {
+		problems = append(problems, "--min-queries-for-backend requires --backend-metrics")
+	}
+	if opt.AbortOnPartialServersAPI && !opt.BackendMetrics {
+		problems = append(problems, "--abort-on-partial-servers-api requires --backend-metrics")
+	}
+	if opt.BackendLatencyBuckets && !opt.BackendMetrics {
+		problems = append(problems, "--backend-latency-buckets requires --backend-metrics")
+	}
+	if opt.ZeroOnRemove && !opt.BackendMetrics && !opt.FrontendMetrics && !opt.PoolMetrics {
+		problems = append(problems, "--zero-on-remove requires --backend-metrics, --frontend-metrics or --pool-metrics")
+	}
+	if opt.Retry < 0 {
+		problems = append(problems, "--retry must not be negative")
+	}
+	if opt.NoRetryOn5xx && opt.Retry == 0 {
+		problems = append(problems, "--no-retry-on-5xx requires --retry")
+	}
+	if opt.AssertMinMetrics < 0 {
+		problems = append(problems, "--assert-min-metrics must not be negative")
+	}
+	if opt.DropMetricsOnErrorCount < 0 {
+		problems = append(problems, "--drop-metrics-on-error-count must not be negative")
+	}
+	if opt.CacheRatioWindow < 0 {
+		problems = append(problems, "--cache-ratio-window must not be negative")
+	}
+	if opt.CircuitBreaker && opt.CircuitBreakerThreshold < 1 {
+		problems = append(problems, "--circuit-breaker-threshold must be 1 or more")
+	}
+	return problems
+}
+
+func enabled(b bool) string {
+	if b {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+// writeConfig writes the effective configuration
+func writeConfig(w io.Writer, opt *Opt) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "prefix\t%s\n", opt.Prefix)
+	fmt.Fprintf(tw, "output format\t%s\n", opt.outputFormat())
+	if opt.GraphSuffix != "" {
+		fmt.Fprintf(tw, "graph suffix\t%s\n", opt.GraphSuffix)
+	}
+	fmt.Fprintf(tw, "stats url\t%s\n", opt.URL())
+	fmt.Fprintf(tw, "servers api url\t%s\n", opt.ServersURL())
+	fmt.Fprintf(tw, "timeout\t%s\n", opt.Timeout)
+	if opt.StatsTimeout > 0 {
+		fmt.Fprintf(tw, "stats timeout\t%s\n", opt.StatsTimeout)
+	}
+	if opt.APITimeout > 0 {
+		fmt.Fprintf(tw, "api timeout\t%s\n", opt.APITimeout)
+	}
+	fmt.Fprintf(tw, "retry\t%d (interval %s)\n", opt.Retry, opt.RetryInterval)
+	if opt.SOCKS5 != "" {
+		fmt.Fprintf(tw, "socks5\t%s\n", opt.SOCKS5)
+	}
+	fmt.Fprintf(tw, "dynblocks\t%s\n", enabled(opt.DynBlocks))
+	fmt.Fprintf(tw, "rule metrics\t%s\n", enabled(opt.RuleMetrics))
+	fmt.Fprintf(tw, "backend metrics\t%s\n", enabled(opt.BackendMetrics))
+	fmt.Fprintf(tw, "frontend metrics\t%s\n", enabled(opt.FrontendMetrics))
+	fmt.Fprintf(tw, "pool metrics\t%s\n", enabled(opt.PoolMetrics))
+	if len(opt.OnlyBackends) > 0 {
+		fmt.Fprintf(tw, "only backends\t%s\n", strings.Join(opt.OnlyBackends, ","))
+	}
+	if len(opt.OnlyPools) > 0 {
+		fmt.Fprintf(tw, "only pools\t%s\n", strings.Join(opt.OnlyPools, ","))
+	}
+	fmt.Fprintf(tw, "circuit breaker\t%s\n", enabled(opt.CircuitBreaker))
+	return tw.Flush()
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateConfig(t *testing.T) {
+	valid := func() Opt {
+		return Opt{Prefix: "dnsdist", Scheme: "http", Port: "8083", Host: "127.0.0.1", Timeout: 30 * time.Second, OutputFormat: "mackerel"}
+	}
+	opt := valid()
+	// --timeout does not bound reading the body
+	opt.ReadTimeout = 60 * time.Second
+	if problems := validateConfig(&opt); len(problems) > 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+
+	opt = valid()
+	opt.Insecure = true
+	opt.NoRetryOn5xx = true
+	if problems := validateConfig(&opt); len(problems) != 2 {
+		t.Errorf("expected 2 problems, got %v", problems)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+)
+
+var versionRegexp = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)`)
+
+// versionNumber parses a version such as 0.0.4 or v1.2.3-rc1 into a
+// comparable number, major*1000000 + minor*1000 + patch
+func versionNumber(v string) (float64, bool) {
+	m := versionRegexp.FindStringSubmatch(v)
+	if m == nil {
+		return 0, false
+	}
+	n := 0.0
+	for _, s := range m[1:] {
+		i, err := strconv.Atoi(s)
+		if err != nil || i >= 1000 {
+			return 0, false
+		}
+		n = n*1000 + float64(i)
+	}
+	return n, true
+}
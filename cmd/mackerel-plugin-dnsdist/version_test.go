@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestVersionNumber(t *testing.T) {
+	tests := []struct {
+		version string
+		want    float64
+		ok      bool
+	}{
+		{"0.0.4", 4, true},
+		{"v1.2.3", 1002003, true},
+		{"1.10.0-rc1", 1010000, true},
+		{"999.999.999", 999999999, true},
+		{"1.1000.0", 0, false},
+		{"1.2", 0, false},
+		{"", 0, false},
+		{"dev", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := versionNumber(tt.version)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %v %v, want %v %v", tt.version, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -4,10 +4,11 @@ go 1.18
 
 require github.com/mackerelio/go-mackerel-plugin v0.1.4
 
-require golang.org/x/sys v0.0.0-20210320140829-1e4c9ba3b0c4 // indirect
+require golang.org/x/sys v0.5.0 // indirect
 
 require (
 	github.com/jessevdk/go-flags v1.5.0
-	github.com/mackerelio/golib v1.2.1 // indirect
-	golang.org/x/text v0.3.7 // indirect
+	github.com/mackerelio/golib v1.2.1
+	golang.org/x/net v0.7.0
+	golang.org/x/text v0.7.0
 )